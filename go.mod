@@ -1,21 +1,37 @@
 module github.com/justinbarrick/gitops-controller
 
 require (
+	filippo.io/age v1.0.0
 	github.com/BurntSushi/toml v0.3.1 // indirect
-	github.com/Masterminds/semver v1.4.2 // indirect
+	github.com/Masterminds/semver v1.4.2
+	github.com/PuerkitoBio/purell v1.1.0 // indirect
+	github.com/PuerkitoBio/urlesc v0.0.0-20170810143723-de5bf2ad4578 // indirect
 	github.com/appscode/jsonpatch v0.0.0-20190108182946-7c0e3b262f30
 	github.com/cameront/go-jsonpatch v0.0.0-20180223123257-a8710867776e
 	github.com/cyphar/filepath-securejoin v0.2.2 // indirect
 	github.com/davecgh/go-spew v1.1.1
+	github.com/emicklei/go-restful v2.9.5+incompatible // indirect
 	github.com/evanphx/json-patch v4.0.0+incompatible
+	github.com/go-openapi/jsonpointer v0.17.0 // indirect
+	github.com/go-openapi/jsonreference v0.17.0 // indirect
+	github.com/go-openapi/spec v0.17.2 // indirect
+	github.com/go-openapi/swag v0.17.0 // indirect
 	github.com/gobwas/glob v0.2.3 // indirect
+	github.com/google/go-jsonnet v0.12.1
 	github.com/jinzhu/inflection v0.0.0-20180308033659-04140366298a
 	github.com/justinbarrick/backup-controller v0.0.0-20190222144618-0c646e0fe0a4
 	github.com/kubernetes-csi/external-snapshotter v1.0.1
 	github.com/kubernetes/client-go v10.0.0+incompatible
+	github.com/mailru/easyjson v0.0.0-20180823135443-60711f1a8329 // indirect
+	github.com/prometheus/client_golang v0.9.2
 	github.com/stretchr/testify v1.3.0
 	github.com/weaveworks/flux v0.0.0-20190222140116-91ec3fd66782
 	github.com/xeipuuv/gojsonpointer v0.0.0-20180127040702-4e3ac2762d5f // indirect
+	go.yaml.in/yaml/v3 v3.0.4
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	gopkg.in/src-d/go-billy.v4 v4.2.1
 	gopkg.in/src-d/go-git.v4 v4.10.0
 	gopkg.in/yaml.v2 v2.2.2
@@ -25,4 +41,5 @@ require (
 	k8s.io/client-go v2.0.0-alpha.0.0.20190115175254-86dbf26d38ed+incompatible
 	k8s.io/helm v2.12.3+incompatible // indirect
 	sigs.k8s.io/controller-runtime v0.1.10
+	sigs.k8s.io/kustomize v2.0.3+incompatible
 )
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Copy the value at the path in src to the same path in dst. Lists cannot be
+// partially applied, so a path into a list copies the whole list.
+func copyPath(dst, src map[string]interface{}, path []string) {
+	for i, segment := range path {
+		value, ok := src[segment]
+		if !ok {
+			return
+		}
+
+		next, isMap := value.(map[string]interface{})
+		if i == len(path)-1 || !isMap {
+			dst[segment] = runtime.DeepCopyJSONValue(value)
+			return
+		}
+
+		if _, ok := dst[segment].(map[string]interface{}); !ok {
+			dst[segment] = map[string]interface{}{}
+		}
+
+		dst = dst[segment].(map[string]interface{})
+		src = next
+	}
+}
+
+// Return the configuration the rule applies to Kubernetes for an object in Git: the
+// object without server-populated fields, restricted to the paths matched by the
+// rule's filters if it has any.
+func (r *Rule) ApplyConfiguration(obj runtime.Object) (*unstructured.Unstructured, error) {
+	var content map[string]interface{}
+
+	stripped := util.StripObject(obj)
+	if asUnstructured, ok := stripped.(*unstructured.Unstructured); ok {
+		content = asUnstructured.Object
+	} else {
+		var err error
+		content, err = runtime.DefaultUnstructuredConverter.ToUnstructured(stripped)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r.Filters) == 0 {
+		return &unstructured.Unstructured{Object: content}, nil
+	}
+
+	meta := util.GetMeta(obj)
+
+	applied := &unstructured.Unstructured{}
+	applied.SetGroupVersionKind(util.GetType(obj))
+	applied.SetName(meta.GetName())
+	applied.SetNamespace(meta.GetNamespace())
+
+	for _, filter := range r.Filters {
+		path := util.SplitPointer(filter)
+		if len(path) == 0 {
+			return &unstructured.Unstructured{Object: content}, nil
+		}
+
+		copyPath(applied.Object, content, path)
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"bytes"
+	"github.com/appscode/jsonpatch"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"text/template"
+)
+
+// The commit message used when neither the configuration nor the rule sets one.
+// The body lists every path that was changed so that `git log` shows what
+// actually happened.
+const DefaultCommitMessage = `{{.Action}} resource {{.Kind}}/{{.Namespace}}/{{.Name}}
+{{- if .Patch}}
+
+Changed paths:
+{{- range .Patch}}
+  {{.Operation}} {{.Path}}
+{{- end}}
+{{- end}}
+{{- if .Manager}}
+
+Last modified by: {{.Manager}}
+{{- end}}
+{{- if .Cluster}}
+Cluster: {{.Cluster}}
+{{- end}}
+`
+
+// The data available to commit message templates.
+type CommitInfo struct {
+	// The action that was taken: Adding, Updating or Removing.
+	Action string
+	// The API group of the object.
+	Group string
+	// The API version of the object.
+	Version string
+	// The kind of the object.
+	Kind string
+	// The namespace of the object.
+	Namespace string
+	// The name of the object.
+	Name string
+	// The rule that matched the object.
+	Rule *Rule
+	// The JSON patch that was applied to the object in Git.
+	Patch []jsonpatch.Operation
+	// The name of the cluster the controller is running in.
+	Cluster string
+	// The Kubernetes user or field manager that last modified the object.
+	Manager string
+}
+
+// Render the commit message for a change, using the rule's commitMessage if set,
+// falling back to the configuration's commitMessage and finally to
+// DefaultCommitMessage.
+func (c *Config) RenderCommitMessage(rule *Rule, info CommitInfo) (string, error) {
+	message := DefaultCommitMessage
+	if c.CommitMessage != "" {
+		message = c.CommitMessage
+	}
+
+	if rule != nil && rule.CommitMessage != "" {
+		message = rule.CommitMessage
+	}
+
+	tmpl, err := template.New("commitMessage").Funcs(util.TemplateFuncs).Parse(message)
+	if err != nil {
+		return "", err
+	}
+
+	info.Rule = rule
+	info.Cluster = c.ClusterName
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, info); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
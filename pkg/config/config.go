@@ -17,6 +17,7 @@ import (
 	"os"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 	"strings"
+	"time"
 )
 
 type SyncType string
@@ -27,34 +28,15 @@ const (
 )
 
 func PatchObject(original, current runtime.Object, rule *Rule) (runtime.Object, error) {
-	patch := admission.PatchResponse(original, current)
-	patches := []jsonpatch.Operation{}
-
-	for _, patch := range patch.Patches {
-		matched := false
-
-		if len(rule.Filters) == 0 {
-			matched = true
-		}
-
-		for _, filter := range rule.Filters {
-			match, err := util.PatchMatchesPath(patch, filter)
-			if err != nil {
-				return nil, err
-			}
-
-			if !match {
-				continue
-			}
-
-			matched = true
-		}
-
-		if !matched {
-			continue
-		}
+	patches, err := rule.FilterPatches(admission.PatchResponse(original, current).Patches)
+	if err != nil {
+		return nil, err
+	}
 
-		patches = append(patches, patch)
+	// Equivalent values, such as 1000m and 1, are left as they are.
+	patches, err = util.SemanticPatches(original, patches)
+	if err != nil {
+		return nil, err
 	}
 
 	serialized, err := json.Marshal(original)
@@ -103,6 +85,41 @@ type Rule struct {
 	// Which direction to sync resources. If syncTo is set to kubernetes, sync from
 	// git to kubernetes. If syncTo is set to git, sync from kubernetes to git.
 	SyncTo SyncType `yaml:"syncTo"`
+	// Go template used to render the commit message for changes made by this rule,
+	// overrides the global commitMessage.
+	CommitMessage string `yaml:"commitMessage,omitempty"`
+	// Go template used to choose the path of new objects written by this rule,
+	// overrides the global path.
+	Path string `yaml:"path,omitempty"`
+	// If true, objects synced to Kubernetes take ownership of fields that are
+	// owned by other field managers instead of failing with a conflict.
+	Force bool `yaml:"force,omitempty"`
+}
+
+// Return the patches that change paths matched by the rule's filters, or every
+// patch if the rule has no filters.
+func (r *Rule) FilterPatches(patches []jsonpatch.Operation) ([]jsonpatch.Operation, error) {
+	if len(r.Filters) == 0 {
+		return patches, nil
+	}
+
+	filtered := []jsonpatch.Operation{}
+
+	for _, patch := range patches {
+		for _, filter := range r.Filters {
+			match, err := util.PatchMatchesPath(patch, filter)
+			if err != nil {
+				return nil, err
+			}
+
+			if match {
+				filtered = append(filtered, patch)
+				break
+			}
+		}
+	}
+
+	return filtered, nil
 }
 
 // Return the normalized version of the list of resources
@@ -200,16 +217,208 @@ func (r *Rule) Matches(k8sState runtime.Object, gitState runtime.Object, typeOnl
 	return true, nil
 }
 
+// Settings for evaluating Jsonnet files.
+type Jsonnet struct {
+	// Directories to search for imports, relative to gitPath.
+	LibraryPaths []string `yaml:"libraryPaths,omitempty"`
+	// External variables, available to Jsonnet files with std.extVar.
+	ExtVars map[string]string `yaml:"extVars,omitempty"`
+}
+
+// A ConfigMap or Secret to read variables from.
+type VariableSource struct {
+	// Either ConfigMap or Secret.
+	Kind      string `yaml:"kind"`
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+}
+
+// A string field whose values are written to separate files next to their manifest.
+type ExternalField struct {
+	// The kind of the objects the field is in.
+	Kind string `yaml:"kind"`
+	// Dot separated path of the field. If the field is a map, each of its values is
+	// written to a file named after its key.
+	Path string `yaml:"path"`
+	// The values are base64 encoded and are written to their files decoded.
+	Binary bool `yaml:"binary,omitempty"`
+}
+
+// Settings for writing string fields to separate files.
+type ExternalFiles struct {
+	// Fields to write to separate files.
+	Fields []ExternalField `yaml:"fields,omitempty"`
+	// Values shorter than this many bytes are kept in the manifest.
+	MinSize int `yaml:"minSize,omitempty"`
+}
+
+// A key in a Secret.
+type SecretKeyRef struct {
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+	Key       string `yaml:"key"`
+}
+
+// A field whose values are encrypted in Git.
+type EncryptedField struct {
+	// The kind of the objects the field is in.
+	Kind string `yaml:"kind"`
+	// Dot separated path of the field. Every string below the field is encrypted.
+	Path string `yaml:"path"`
+}
+
+// Settings for encrypting fields in Git with age.
+type Encryption struct {
+	// The age recipients to encrypt values for.
+	Recipients []string `yaml:"recipients,omitempty"`
+	// The Secret key holding the age identities used to decrypt values, required.
+	KeySecret *SecretKeyRef `yaml:"keySecret,omitempty"`
+	// Fields to encrypt, defaults to the data and stringData of Secrets.
+	Fields []EncryptedField `yaml:"fields,omitempty"`
+}
+
+// A field whose values are redacted in Git.
+type RedactedField struct {
+	// The kind of the objects the field is in.
+	Kind string `yaml:"kind"`
+	// Dot separated path of the field. Every string below the field is redacted.
+	Path string `yaml:"path"`
+}
+
+// Settings for redacting fields in Git.
+type Redaction struct {
+	// Fields to redact, defaults to the data and stringData of Secrets.
+	Fields []RedactedField `yaml:"fields,omitempty"`
+	// The Secret key holding the salt values are hashed with, required.
+	SaltSecret *SecretKeyRef `yaml:"saltSecret,omitempty"`
+}
+
+// Settings for receiving push webhooks from GitHub, GitLab, Gitea and Bitbucket.
+type Webhook struct {
+	// The address to receive webhooks on, defaults to :9113.
+	Address string `yaml:"address,omitempty"`
+	// The Secret key holding the secret webhooks are signed with, or the GitLab
+	// token.
+	Secret *SecretKeyRef `yaml:"secret"`
+}
+
+// Pins the revision of the repository that is synced to Kubernetes. Exactly one
+// field must be set.
+type Pin struct {
+	// A tag to sync.
+	Tag string `yaml:"tag,omitempty"`
+	// A full commit SHA to sync.
+	Commit string `yaml:"commit,omitempty"`
+	// A semantic version range, the newest tag that satisfies it is synced.
+	Semver string `yaml:"semver,omitempty"`
+}
+
+// Settings for verifying that commits are signed by trusted keys before they are
+// synced to Kubernetes. At least one of the Secret keys must be set.
+type Verification struct {
+	// The Secret key holding an armored GPG keyring of trusted public keys.
+	KeyRingSecret *SecretKeyRef `yaml:"keyRingSecret,omitempty"`
+	// The Secret key holding trusted SSH public keys in authorized_keys format.
+	SSHKeysSecret *SecretKeyRef `yaml:"sshKeysSecret,omitempty"`
+	// The Secret key holding an armored GPG private key that the controller signs
+	// its commits with. Its public key is trusted.
+	SigningKeySecret *SecretKeyRef `yaml:"signingKeySecret,omitempty"`
+}
+
 // Configuration for the gitops-controller.
 type Config struct {
-	// The git branch to use.
+	// The git branch to use. Objects synced to Git are always committed to it.
 	Branch string `yaml:"branch,omitempty"`
+	// If set, objects are synced to Kubernetes from this revision instead of from
+	// the head of branch.
+	Pin *Pin `yaml:"pin,omitempty"`
 	// Path inside of the Git repository to use as working directory.
 	GitPath string `yaml:"gitPath,omitempty"`
 	// URL to the Git repository to clone.
 	GitURL string `yaml:"gitUrl,omitempty"`
 	// Rules to load.
 	Rules []Rule `yaml:"rules"`
+	// Go template used to render commit messages, see CommitInfo for the available
+	// fields.
+	CommitMessage string `yaml:"commitMessage,omitempty"`
+	// Name of the cluster the controller is running in, made available to commit
+	// message templates.
+	ClusterName string `yaml:"clusterName,omitempty"`
+	// Go template used to choose the path, relative to gitPath, that new objects
+	// are written to, see PathInfo for the available fields.
+	Path string `yaml:"path,omitempty"`
+	// Settings for evaluating Jsonnet files.
+	Jsonnet Jsonnet `yaml:"jsonnet,omitempty"`
+	// Values for ${VAR} placeholders in manifests.
+	Variables map[string]string `yaml:"variables,omitempty"`
+	// ConfigMaps and Secrets to read values for placeholders from, overriding
+	// variables.
+	VariablesFrom []VariableSource `yaml:"variablesFrom,omitempty"`
+	// Fail to load manifests with placeholders that have no value or default.
+	StrictVariables bool `yaml:"strictVariables,omitempty"`
+	// Glob patterns, relative to gitPath, of the files to load as manifests. If
+	// empty, every YAML and JSON file is loaded.
+	Include []string `yaml:"include,omitempty"`
+	// Glob patterns, relative to gitPath, of files and directories to skip.
+	Exclude []string `yaml:"exclude,omitempty"`
+	// String fields to write to separate files next to their manifest.
+	ExternalFiles ExternalFiles `yaml:"externalFiles,omitempty"`
+	// Settings for redacting fields in Git.
+	Redaction *Redaction `yaml:"redaction,omitempty"`
+	// Settings for encrypting fields in Git.
+	Encryption *Encryption `yaml:"encryption,omitempty"`
+	// If set, only commits signed by trusted keys are synced to Kubernetes.
+	Verification *Verification `yaml:"verification,omitempty"`
+	// The field manager objects are applied to Kubernetes as, defaults to
+	// gitops-controller.
+	FieldManager string `yaml:"fieldManager,omitempty"`
+	// The address to serve the status API on.
+	StatusAddress string `yaml:"statusAddress,omitempty"`
+	// Settings for receiving push webhooks, if set the repository is polled less
+	// often.
+	Webhook *Webhook `yaml:"webhook,omitempty"`
+	// How often to check the repository for new commits, defaults to 30s, or 5m if
+	// webhooks are received.
+	ResyncInterval time.Duration `yaml:"resyncInterval,omitempty"`
+	// The longest random delay added to each resync interval.
+	ResyncJitter time.Duration `yaml:"resyncJitter,omitempty"`
+}
+
+// Return true if placeholders in manifests should be substituted.
+func (c *Config) SubstitutesVariables() bool {
+	return len(c.Variables) != 0 || len(c.VariablesFrom) != 0 || c.StrictVariables
+}
+
+// Return true if any rule syncs objects to Git.
+func (c *Config) SyncsToGit() bool {
+	for _, rule := range c.Rules {
+		if rule.SyncTo == Git {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return true if variables, keys or salts are read from ConfigMaps or Secrets.
+func (c *Config) ReadsFromCluster() bool {
+	if c.SubstitutesVariables() {
+		return true
+	}
+
+	if c.Encryption != nil {
+		return true
+	}
+
+	if c.Redaction != nil {
+		return true
+	}
+
+	if c.Verification != nil {
+		return true
+	}
+
+	return c.Webhook != nil
 }
 
 func NewConfig(path string) (*Config, error) {
@@ -226,9 +435,24 @@ func NewConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	config.GitPath = *flag.String("git-path", config.GitPath, "The path inside of the Git repository to work in.")
-	config.GitURL = *flag.String("git-url", config.GitURL, "The URL to the Git repository to clone")
-	config.Branch = *flag.String("branch", config.Branch, "The Git branch to use")
+	// The flags default to the configuration file and set the fields when parsed.
+	flag.StringVar(&config.GitPath, "git-path", config.GitPath, "The path inside of the Git repository to work in.")
+	flag.StringVar(&config.GitURL, "git-url", config.GitURL, "The URL to the Git repository to clone")
+	flag.StringVar(&config.Branch, "branch", config.Branch, "The Git branch to use")
+
+	if config.FieldManager == "" {
+		config.FieldManager = "gitops-controller"
+	}
+
+	if config.StatusAddress == "" {
+		config.StatusAddress = ":9112"
+	}
+
+	flag.StringVar(&config.StatusAddress, "status-address", config.StatusAddress, "The address to serve the status API on.")
+
+	if config.Webhook != nil && config.Webhook.Address == "" {
+		config.Webhook.Address = ":9113"
+	}
 
 	flag.Parse()
 
@@ -236,6 +460,31 @@ func NewConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("No -git-url provided.")
 	}
 
+	if config.Webhook != nil && config.Webhook.Secret == nil {
+		return nil, fmt.Errorf("webhook.secret must be set to verify webhooks.")
+	}
+
+	// Encrypted manifests cannot be loaded without the identities, so every sync
+	// would add another copy of their objects.
+	if config.Encryption != nil && config.Encryption.KeySecret == nil {
+		return nil, fmt.Errorf("encryption.keySecret must be set to decrypt encrypted fields.")
+	}
+
+	// Unsalted hashes of short values, such as passwords, are easily reversed.
+	if config.Redaction != nil && config.Redaction.SaltSecret == nil {
+		return nil, fmt.Errorf("redaction.saltSecret must be set to hash redacted values.")
+	}
+
+	if config.Verification != nil && config.Verification.KeyRingSecret == nil && config.Verification.SSHKeysSecret == nil {
+		return nil, fmt.Errorf("verification.keyRingSecret or verification.sshKeysSecret must be set to verify commits.")
+	}
+
+	// The head of the branch is verified when the controller starts, so unsigned
+	// commits synced to Git would stop anything from being synced to Kubernetes.
+	if config.Verification != nil && config.Verification.SigningKeySecret == nil && config.Pin == nil && config.SyncsToGit() {
+		return nil, fmt.Errorf("verification.signingKeySecret must be set to sign the commits of rules that sync to Git.")
+	}
+
 	return config, nil
 }
 
@@ -1,9 +1,11 @@
 package config
 
 import (
+	"github.com/appscode/jsonpatch"
 	"github.com/justinbarrick/gitops-controller/pkg/util"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"testing"
 )
@@ -253,3 +255,111 @@ func TestRules(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderCommitMessage(t *testing.T) {
+	info := CommitInfo{
+		Action:    "Updating",
+		Kind:      "Deployment",
+		Namespace: "hello",
+		Name:      "test",
+		Manager:   "kubectl",
+		Patch: []jsonpatch.Operation{
+			jsonpatch.NewPatch("add", "/metadata/labels", map[string]string{"a": "label"}),
+		},
+	}
+
+	config := &Config{ClusterName: "prod"}
+
+	message, err := config.RenderCommitMessage(&Rule{}, info)
+	assert.Nil(t, err)
+	assert.Equal(t, `Updating resource Deployment/hello/test
+
+Changed paths:
+  add /metadata/labels
+
+Last modified by: kubectl
+Cluster: prod
+`, message)
+
+	config.CommitMessage = "{{.Kind | lower}} {{.Name}} on {{.Cluster}}"
+	message, err = config.RenderCommitMessage(&Rule{}, info)
+	assert.Nil(t, err)
+	assert.Equal(t, "deployment test on prod", message)
+
+	message, err = config.RenderCommitMessage(&Rule{
+		CommitMessage: "{{.Action}} {{.Rule.SyncTo}}",
+		SyncTo:        Git,
+	}, info)
+	assert.Nil(t, err)
+	assert.Equal(t, "Updating git", message)
+}
+
+func TestRenderPath(t *testing.T) {
+	deployment := labeled(util.DefaultObject(util.Kind("Deployment", "apps", "v1"), "test", "hello"))
+
+	config := &Config{}
+
+	path, err := config.RenderPath(&Rule{}, deployment)
+	assert.Nil(t, err)
+	assert.Equal(t, "", path)
+
+	config.Path = "{{.Namespace | default \"cluster\"}}/{{.Group}}/{{.Kind | lower}}/{{.Name}}.yaml"
+	path, err = config.RenderPath(&Rule{}, deployment)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello/apps/deployment/test.yaml", path)
+
+	path, err = config.RenderPath(&Rule{Path: "apps/{{.Labels.a}}.yaml"}, deployment)
+	assert.Nil(t, err)
+	assert.Equal(t, "apps/label.yaml", path)
+
+	_, err = config.RenderPath(&Rule{Path: "apps/{{.Labels.app}}.yaml"}, deployment)
+	assert.NotNil(t, err)
+}
+
+func TestApplyConfiguration(t *testing.T) {
+	deployment := annotated(labeled(util.DefaultObject(util.Kind("Deployment", "apps", "v1"), "test", "hello")))
+
+	asUnstructured := deployment.(*unstructured.Unstructured)
+	asUnstructured.SetResourceVersion("1234")
+	unstructured.SetNestedField(asUnstructured.Object, int64(3), "spec", "replicas")
+	unstructured.SetNestedField(asUnstructured.Object, "ok", "status", "phase")
+	unstructured.SetNestedSlice(asUnstructured.Object, []interface{}{
+		map[string]interface{}{"manager": "kubectl"},
+	}, "metadata", "managedFields")
+
+	applied, err := (&Rule{}).ApplyConfiguration(deployment)
+	assert.Nil(t, err)
+
+	expected := annotated(labeled(util.DefaultObject(util.Kind("Deployment", "apps", "v1"), "test", "hello"))).(*unstructured.Unstructured)
+	unstructured.SetNestedField(expected.Object, int64(3), "spec", "replicas")
+	assert.Equal(t, expected, applied)
+
+	applied, err = (&Rule{Filters: []string{"/metadata/labels", "/spec/replicas", "/spec/missing"}}).ApplyConfiguration(deployment)
+	assert.Nil(t, err)
+
+	expected = labeled(util.DefaultObject(util.Kind("Deployment", "apps", "v1"), "test", "hello")).(*unstructured.Unstructured)
+	unstructured.SetNestedField(expected.Object, int64(3), "spec", "replicas")
+	assert.Equal(t, expected, applied)
+
+	// The original object is not modified.
+	assert.Equal(t, "1234", asUnstructured.GetResourceVersion())
+}
+
+func TestPatchObjectKeepsEquivalentValues(t *testing.T) {
+	original := util.DefaultObject(util.Kind("Deployment", "apps", "v1"), "test", "hello").(*unstructured.Unstructured)
+	unstructured.SetNestedField(original.Object, "1000m", "spec", "template", "spec", "resources", "limits", "cpu")
+	unstructured.SetNestedField(original.Object, int64(2), "spec", "replicas")
+
+	current := original.DeepCopy()
+	unstructured.SetNestedField(current.Object, "1", "spec", "template", "spec", "resources", "limits", "cpu")
+	unstructured.SetNestedField(current.Object, int64(3), "spec", "replicas")
+
+	patched, err := PatchObject(original, current, &Rule{})
+	assert.Nil(t, err)
+
+	cpu, _, _ := unstructured.NestedString(patched.(*unstructured.Unstructured).Object, "spec", "template", "spec", "resources", "limits", "cpu")
+	assert.Equal(t, "1000m", cpu)
+
+	replicas, _, _ := unstructured.NestedInt64(patched.(*unstructured.Unstructured).Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"bytes"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"k8s.io/apimachinery/pkg/runtime"
+	"text/template"
+)
+
+// The data available to path templates.
+type PathInfo struct {
+	// The API group of the object.
+	Group string
+	// The API version of the object.
+	Version string
+	// The kind of the object.
+	Kind string
+	// The namespace of the object, empty for cluster-scoped objects.
+	Namespace string
+	// The name of the object.
+	Name string
+	// The labels on the object.
+	Labels map[string]string
+}
+
+// Render the path, relative to the working directory, that a new object should be
+// written to. The rule's path is used if it is set, otherwise the configuration's
+// path. Returns an empty string if neither is set.
+func (c *Config) RenderPath(rule *Rule, obj runtime.Object) (string, error) {
+	path := c.Path
+	if rule != nil && rule.Path != "" {
+		path = rule.Path
+	}
+
+	if path == "" {
+		return "", nil
+	}
+
+	tmpl, err := template.New("path").Funcs(util.TemplateFuncs).Option("missingkey=error").Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	meta := util.GetMeta(obj)
+	kind := util.GetType(obj)
+
+	labels := meta.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, PathInfo{
+		Group:     kind.Group,
+		Version:   kind.Version,
+		Kind:      kind.Kind,
+		Namespace: meta.GetNamespace(),
+		Name:      meta.GetName(),
+		Labels:    labels,
+	}); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
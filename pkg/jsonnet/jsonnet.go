@@ -0,0 +1,224 @@
+package jsonnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-jsonnet"
+	"github.com/justinbarrick/gitops-controller/pkg/config"
+	"github.com/justinbarrick/gitops-controller/pkg/repo"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"gopkg.in/src-d/go-billy.v4"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Evaluates Jsonnet files in the repository into objects.
+type Generator struct {
+	Config config.Jsonnet
+	// The library paths, relative to the root of the repository.
+	libraryPaths []string
+}
+
+func (g *Generator) Name() string {
+	return "jsonnet"
+}
+
+// Find every .jsonnet file in workDir. Each is a source whose inputs are the file
+// itself and every .libsonnet file, along with the .libsonnet and .jsonnet files in
+// the library paths, so that a change to any library causes it to be evaluated
+// again. Other files in the library paths are not inputs, so a library path that
+// contains manifests does not claim them.
+func (g *Generator) Find(fs billy.Filesystem, workDir string) ([]repo.Source, error) {
+	g.libraryPaths = []string{}
+	for _, path := range g.Config.LibraryPaths {
+		g.libraryPaths = append(g.libraryPaths, filepath.Join(workDir, path))
+	}
+
+	files := []string{}
+	libraries := map[string]bool{}
+
+	err := util.WalkAll(fs, workDir, func(path string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+
+		switch filepath.Ext(path) {
+		case ".jsonnet":
+			files = append(files, path)
+		case ".libsonnet":
+			libraries[path] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, libraryPath := range g.libraryPaths {
+		err := util.WalkAll(fs, libraryPath, func(path string, info os.FileInfo) error {
+			if ext := filepath.Ext(path); !info.IsDir() && (ext == ".libsonnet" || ext == ".jsonnet") {
+				libraries[path] = true
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(files)
+
+	libraryFiles := []string{}
+	for path := range libraries {
+		libraryFiles = append(libraryFiles, path)
+	}
+
+	sort.Strings(libraryFiles)
+
+	sources := []repo.Source{}
+	for _, file := range files {
+		inputs := []string{file}
+		for _, library := range libraryFiles {
+			if library != file {
+				inputs = append(inputs, library)
+			}
+		}
+
+		sources = append(sources, repo.Source{
+			Path:   file,
+			Inputs: inputs,
+		})
+	}
+
+	return sources, nil
+}
+
+// Resolves imports from the repository, first relative to the importing file and
+// then in each of the library paths.
+type importer struct {
+	fs           billy.Filesystem
+	libraryPaths []string
+}
+
+func (i *importer) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+	candidates := []string{filepath.Join(filepath.Dir(importedFrom), importedPath)}
+	for _, path := range i.libraryPaths {
+		candidates = append(candidates, filepath.Join(path, importedPath))
+	}
+
+	for _, path := range candidates {
+		data, err := util.ReadFile(i.fs, path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return jsonnet.Contents{}, "", err
+		}
+
+		return jsonnet.MakeContents(string(data)), path, nil
+	}
+
+	return jsonnet.Contents{}, "", fmt.Errorf("couldn't find import %s from %s", importedPath, importedFrom)
+}
+
+// Collect the objects in an evaluated Jsonnet value. A value can be an object, a
+// List, an array of values or an object whose fields are values.
+func collectObjects(value interface{}) ([]map[string]interface{}, error) {
+	objects := []map[string]interface{}{}
+
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			found, err := collectObjects(item)
+			if err != nil {
+				return nil, err
+			}
+
+			objects = append(objects, found...)
+		}
+	case map[string]interface{}:
+		if _, ok := v["apiVersion"]; ok {
+			if kind, _ := v["kind"].(string); kind == "List" {
+				return collectObjects(v["items"])
+			}
+
+			return append(objects, v), nil
+		}
+
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			found, err := collectObjects(v[key])
+			if err != nil {
+				return nil, err
+			}
+
+			objects = append(objects, found...)
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("unexpected value in Jsonnet output: %v", value)
+	}
+
+	return objects, nil
+}
+
+// Evaluate a Jsonnet file.
+func (g *Generator) Render(fs billy.Filesystem, source repo.Source) ([]*unstructured.Unstructured, error) {
+	data, err := util.ReadFile(fs, source.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(&importer{
+		fs:           fs,
+		libraryPaths: g.libraryPaths,
+	})
+
+	for name, value := range g.Config.ExtVars {
+		vm.ExtVar(name, value)
+	}
+
+	output, err := vm.EvaluateSnippet(source.Path, string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(output), &value); err != nil {
+		return nil, err
+	}
+
+	found, err := collectObjects(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", source.Path, err)
+	}
+
+	objects := []*unstructured.Unstructured{}
+	for _, obj := range found {
+		// Round trip through JSON so that numbers are decoded the same way as in
+		// other manifests.
+		serialized, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		object := &unstructured.Unstructured{}
+		if err := object.UnmarshalJSON(serialized); err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,101 @@
+package jsonnet
+
+import (
+	"github.com/justinbarrick/gitops-controller/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	billyutil "gopkg.in/src-d/go-billy.v4/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"testing"
+)
+
+func TestJsonnet(t *testing.T) {
+	fs := memfs.New()
+
+	for path, contents := range map[string]string{
+		"lib/deployment.libsonnet": `{
+  deployment(name, replicas):: {
+    apiVersion: "apps/v1",
+    kind: "Deployment",
+    metadata: { name: name, namespace: std.extVar("namespace") },
+    spec: { replicas: replicas },
+  },
+}
+`,
+		"manifests/frontend.jsonnet": `local lib = import "deployment.libsonnet";
+{
+  frontend: lib.deployment("frontend", 3),
+  backend: {
+    apiVersion: "v1",
+    kind: "List",
+    items: [lib.deployment("backend", 1)],
+  },
+}
+`,
+	} {
+		assert.Nil(t, billyutil.WriteFile(fs, path, []byte(contents), 0644))
+	}
+
+	generator := &Generator{
+		Config: config.Jsonnet{
+			LibraryPaths: []string{"../lib"},
+			ExtVars: map[string]string{
+				"namespace": "prod",
+			},
+		},
+	}
+
+	sources, err := generator.Find(fs, "manifests")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(sources))
+	assert.Equal(t, "manifests/frontend.jsonnet", sources[0].Path)
+	assert.Equal(t, []string{"manifests/frontend.jsonnet", "lib/deployment.libsonnet"}, sources[0].Inputs)
+
+	objects, err := generator.Render(fs, sources[0])
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(objects))
+	assert.Equal(t, "backend", objects[0].GetName())
+	assert.Equal(t, "frontend", objects[1].GetName())
+	assert.Equal(t, "prod", objects[1].GetNamespace())
+
+	replicas, _, _ := unstructured.NestedInt64(objects[1].Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+}
+
+func TestJsonnetLibraryPathsOnlyClaimLibraries(t *testing.T) {
+	fs := memfs.New()
+
+	for path, contents := range map[string]string{
+		"manifests/frontend.jsonnet":     `import "service.jsonnet"`,
+		"manifests/lib/util.libsonnet":   `{}`,
+		"manifests/service.jsonnet":      `{}`,
+		"manifests/configmap.yaml":       "kind: ConfigMap\n",
+		"manifests/lib/values.json":      `{}`,
+		"vendor/ksonnet/k.libsonnet":     `{}`,
+		"vendor/ksonnet/examples/a.yaml": "kind: ConfigMap\n",
+	} {
+		assert.Nil(t, billyutil.WriteFile(fs, path, []byte(contents), 0644))
+	}
+
+	generator := &Generator{
+		Config: config.Jsonnet{
+			LibraryPaths: []string{".", "../vendor"},
+		},
+	}
+
+	sources, err := generator.Find(fs, "manifests")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(sources))
+	assert.Equal(t, []string{
+		"manifests/frontend.jsonnet",
+		"manifests/lib/util.libsonnet",
+		"manifests/service.jsonnet",
+		"vendor/ksonnet/k.libsonnet",
+	}, sources[0].Inputs)
+
+	for _, source := range sources {
+		assert.False(t, source.Claims("manifests/configmap.yaml"))
+		assert.False(t, source.Claims("manifests/lib/values.json"))
+		assert.False(t, source.Claims("vendor/ksonnet/examples/a.yaml"))
+	}
+}
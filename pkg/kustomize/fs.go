@@ -0,0 +1,121 @@
+package kustomize
+
+import (
+	"errors"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"gopkg.in/src-d/go-billy.v4"
+	billyutil "gopkg.in/src-d/go-billy.v4/util"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/kustomize/pkg/fs"
+	"strings"
+)
+
+// Returned when kustomize tries to change the repository.
+var errReadOnly = errors.New("the repository is read-only while building kustomizations")
+
+// A read-only kustomize filesystem over the repository, rooted at /, so that
+// kustomizations are built without copying the repository.
+type readOnlyFS struct {
+	fs billy.Filesystem
+}
+
+var _ fs.FileSystem = &readOnlyFS{}
+
+// Return the path in the repository of an absolute kustomize path.
+func (r *readOnlyFS) path(name string) string {
+	path := strings.TrimPrefix(filepath.Clean(filepath.Join("/", name)), "/")
+	if path == "" {
+		return "."
+	}
+
+	return path
+}
+
+func (r *readOnlyFS) Create(name string) (fs.File, error) {
+	return nil, errReadOnly
+}
+
+func (r *readOnlyFS) Mkdir(name string) error {
+	return errReadOnly
+}
+
+func (r *readOnlyFS) MkdirAll(name string) error {
+	return errReadOnly
+}
+
+func (r *readOnlyFS) RemoveAll(name string) error {
+	return errReadOnly
+}
+
+func (r *readOnlyFS) WriteFile(name string, data []byte) error {
+	return errReadOnly
+}
+
+func (r *readOnlyFS) Open(name string) (fs.File, error) {
+	path := r.path(name)
+
+	info, err := r.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := r.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &readOnlyFile{File: file, info: info}, nil
+}
+
+func (r *readOnlyFS) IsDir(name string) bool {
+	info, err := r.fs.Stat(r.path(name))
+	return err == nil && info.IsDir()
+}
+
+func (r *readOnlyFS) Exists(name string) bool {
+	_, err := r.fs.Stat(r.path(name))
+	return err == nil
+}
+
+// Split a path into the directory and file it refers to, the same way as kustomize's
+// in-memory filesystem. There are no symlinks in the repository to resolve.
+func (r *readOnlyFS) CleanedAbs(name string) (fs.ConfirmedDir, string, error) {
+	abs := filepath.Join("/", name)
+	if r.IsDir(abs) {
+		return fs.ConfirmedDir(abs), "", nil
+	}
+
+	return fs.ConfirmedDir(filepath.Dir(abs)), filepath.Base(abs), nil
+}
+
+func (r *readOnlyFS) Glob(pattern string) ([]string, error) {
+	matches, err := billyutil.Glob(r.fs, r.path(pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, match := range matches {
+		matches[i] = filepath.Join("/", match)
+	}
+
+	return matches, nil
+}
+
+func (r *readOnlyFS) ReadFile(name string) ([]byte, error) {
+	return util.ReadFile(r.fs, r.path(name))
+}
+
+// A file opened from the repository for reading.
+type readOnlyFile struct {
+	billy.File
+	info os.FileInfo
+}
+
+func (f *readOnlyFile) Write(data []byte) (int, error) {
+	return 0, errReadOnly
+}
+
+func (f *readOnlyFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
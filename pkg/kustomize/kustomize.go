@@ -0,0 +1,199 @@
+package kustomize
+
+import (
+	"bytes"
+	"github.com/justinbarrick/gitops-controller/pkg/repo"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"gopkg.in/src-d/go-billy.v4"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/kustomize/k8sdeps"
+	"sigs.k8s.io/kustomize/pkg/constants"
+	"sigs.k8s.io/kustomize/pkg/loader"
+	"sigs.k8s.io/kustomize/pkg/target"
+	"sigs.k8s.io/kustomize/pkg/types"
+	"sort"
+	"strings"
+)
+
+// Renders directories containing a kustomization into objects.
+type Generator struct{}
+
+func (g *Generator) Name() string {
+	return "kustomize"
+}
+
+// Return the path of the kustomization file in dir, or an empty string if the
+// directory does not contain a kustomization.
+func kustomizationFile(fsys billy.Filesystem, dir string) string {
+	for _, name := range constants.KustomizationFileNames {
+		path := filepath.Join(dir, name)
+		if _, err := fsys.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// Load the kustomization in a directory.
+func loadKustomization(fsys billy.Filesystem, path string) (*types.Kustomization, error) {
+	data, err := util.ReadFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	kustomization := &types.Kustomization{}
+	if err := kyaml.NewYAMLOrJSONDecoder(bytes.NewBuffer(data), len(data)).Decode(kustomization); err != nil {
+		return nil, err
+	}
+
+	return kustomization, nil
+}
+
+// Find every kustomization in workDir that is not used as a base or resource by
+// another kustomization. Each is a source whose inputs are its own directory, the
+// directories of every kustomization it uses and the files it uses from outside of
+// them. A kustomization that cannot be loaded is still a source, so that it is
+// recorded as failing to render rather than its files being loaded as manifests.
+func (g *Generator) Find(fsys billy.Filesystem, workDir string) ([]repo.Source, error) {
+	// The directories of kustomizations and the kustomization directories they use.
+	kustomizations := map[string][]string{}
+	// The files outside of its directory used as resources by each kustomization.
+	files := map[string][]string{}
+
+	err := util.WalkAll(fsys, workDir, func(path string, info os.FileInfo) error {
+		if !info.IsDir() {
+			return nil
+		}
+
+		file := kustomizationFile(fsys, path)
+		if file == "" {
+			return nil
+		}
+
+		path = filepath.Clean(path)
+		kustomizations[path] = []string{}
+
+		kustomization, err := loadKustomization(fsys, file)
+		if err != nil {
+			util.Log.Error(err, "could not load kustomization", "path", file)
+			return nil
+		}
+
+		for _, resource := range append(kustomization.Bases, kustomization.Resources...) {
+			resourcePath := filepath.Join(path, resource)
+
+			if kustomizationFile(fsys, resourcePath) != "" {
+				kustomizations[path] = append(kustomizations[path], resourcePath)
+				continue
+			}
+
+			// Files inside of the directory are already claimed by it.
+			if strings.HasPrefix(resourcePath, path+"/") {
+				continue
+			}
+
+			if info, err := fsys.Stat(resourcePath); err == nil && !info.IsDir() {
+				files[path] = append(files[path], resourcePath)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[string]bool{}
+	for _, uses := range kustomizations {
+		for _, dir := range uses {
+			used[dir] = true
+		}
+	}
+
+	sources := []repo.Source{}
+
+	for dir := range kustomizations {
+		if used[dir] {
+			continue
+		}
+
+		inputs := []string{}
+		seen := map[string]bool{}
+		pending := []string{dir}
+
+		for len(pending) != 0 {
+			current := pending[0]
+			pending = pending[1:]
+
+			if seen[current] {
+				continue
+			}
+
+			seen[current] = true
+			inputs = append(inputs, current)
+			pending = append(pending, kustomizations[current]...)
+
+			for _, file := range files[current] {
+				if !seen[file] {
+					seen[file] = true
+					inputs = append(inputs, file)
+				}
+			}
+		}
+
+		sources = append(sources, repo.Source{
+			Path:   dir,
+			Inputs: inputs,
+		})
+	}
+
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Path < sources[j].Path
+	})
+
+	return sources, nil
+}
+
+// Build the kustomization in the source's directory.
+func (g *Generator) Render(fsys billy.Filesystem, source repo.Source) ([]*unstructured.Unstructured, error) {
+	ldr, err := loader.NewLoader(filepath.Join("/", source.Path), &readOnlyFS{fs: fsys})
+	if err != nil {
+		return nil, err
+	}
+	defer ldr.Cleanup()
+
+	factory := k8sdeps.NewFactory()
+
+	kt, err := target.NewKustTarget(ldr, factory.ResmapF, factory.TransformerF)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := kt.MakeCustomizedResMap()
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []*unstructured.Unstructured{}
+	for _, resource := range resources {
+		objects = append(objects, &unstructured.Unstructured{
+			Object: resource.Map(),
+		})
+	}
+
+	// Resources are stored in a map, sort them so that the order is stable.
+	sort.Slice(objects, func(i, j int) bool {
+		return objectId(objects[i]) < objectId(objects[j])
+	})
+
+	return objects, nil
+}
+
+// Return a string identifying an object, used for sorting.
+func objectId(obj *unstructured.Unstructured) string {
+	return filepath.Join(obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
@@ -0,0 +1,67 @@
+package kustomize
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	billyutil "gopkg.in/src-d/go-billy.v4/util"
+	"testing"
+)
+
+func TestKustomize(t *testing.T) {
+	fs := memfs.New()
+
+	for path, contents := range map[string]string{
+		"manifests/base/kustomization.yaml": "resources:\n- deployment.yaml\n",
+		"manifests/base/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+`,
+		"manifests/prod/kustomization.yaml": "namespace: prod\nnamePrefix: prod-\nbases:\n- ../base\n",
+	} {
+		assert.Nil(t, billyutil.WriteFile(fs, path, []byte(contents), 0644))
+	}
+
+	generator := &Generator{}
+
+	sources, err := generator.Find(fs, "manifests")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(sources))
+	assert.Equal(t, "manifests/prod", sources[0].Path)
+	assert.Equal(t, []string{"manifests/prod", "manifests/base"}, sources[0].Inputs)
+
+	objects, err := generator.Render(fs, sources[0])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, "prod-frontend", objects[0].GetName())
+	assert.Equal(t, "prod", objects[0].GetNamespace())
+}
+
+func TestKustomizeSources(t *testing.T) {
+	fs := memfs.New()
+
+	for path, contents := range map[string]string{
+		"manifests/shared/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+`,
+		"manifests/prod/kustomization.yaml":   "resources:\n- ../shared/deployment.yaml\n",
+		"manifests/broken/kustomization.yaml": "resources: [\n",
+	} {
+		assert.Nil(t, billyutil.WriteFile(fs, path, []byte(contents), 0644))
+	}
+
+	generator := &Generator{}
+
+	sources, err := generator.Find(fs, "manifests")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(sources))
+	assert.Equal(t, "manifests/broken", sources[0].Path)
+	assert.Equal(t, []string{"manifests/broken"}, sources[0].Inputs)
+	assert.Equal(t, "manifests/prod", sources[1].Path)
+	assert.Equal(t, []string{"manifests/prod", "manifests/shared/deployment.yaml"}, sources[1].Inputs)
+
+	_, err = generator.Render(fs, sources[0])
+	assert.NotNil(t, err)
+}
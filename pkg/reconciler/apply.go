@@ -0,0 +1,145 @@
+package reconciler
+
+import (
+	"fmt"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The content type of server-side apply patches.
+const applyPatchType types.PatchType = "application/apply-patch+yaml"
+
+// Returned when applying an object conflicts with fields owned by other field
+// managers.
+type ConflictError struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// The conflicting fields and the managers that own them.
+	Conflicts []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("applying %s %s/%s conflicts with other field managers, set force on the rule to take ownership: %s",
+		e.Kind, e.Namespace, e.Name, strings.Join(e.Conflicts, "; "))
+}
+
+// Applies objects to Kubernetes.
+type Applier interface {
+	// Apply the configuration of an object, creating it if it does not exist. If
+	// force is set, fields owned by other field managers are taken over instead of
+	// returning a ConflictError. If dryRun is set, nothing is persisted. Returns the
+	// object as it is after the apply.
+	Apply(obj *unstructured.Unstructured, force, dryRun bool) (*unstructured.Unstructured, error)
+}
+
+// Applies objects with server-side apply as a field manager.
+type ServerSideApplier struct {
+	config       *rest.Config
+	mapper       meta.RESTMapper
+	fieldManager string
+	clients      map[schema.GroupVersionKind]rest.Interface
+	lock         sync.Mutex
+}
+
+// Create an applier that applies objects as fieldManager.
+func NewServerSideApplier(config *rest.Config, mapper meta.RESTMapper, fieldManager string) *ServerSideApplier {
+	return &ServerSideApplier{
+		config:       config,
+		mapper:       mapper,
+		fieldManager: fieldManager,
+		clients:      map[schema.GroupVersionKind]rest.Interface{},
+	}
+}
+
+// Return the REST client for a kind, creating it if needed.
+func (a *ServerSideApplier) client(gvk schema.GroupVersionKind) (rest.Interface, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if client, ok := a.clients[gvk]; ok {
+		return client, nil
+	}
+
+	client, err := apiutil.RESTClientForGVK(gvk, a.config, serializer.NewCodecFactory(util.Scheme))
+	if err != nil {
+		return nil, err
+	}
+
+	a.clients[gvk] = client
+	return client, nil
+}
+
+func (a *ServerSideApplier) Apply(obj *unstructured.Unstructured, force, dryRun bool) (*unstructured.Unstructured, error) {
+	gvk := obj.GroupVersionKind()
+
+	mapping, err := a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := a.client(gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	request := client.Patch(applyPatchType).
+		NamespaceIfScoped(obj.GetNamespace(), mapping.Scope.Name() == meta.RESTScopeNameNamespace).
+		Resource(mapping.Resource.Resource).
+		Name(obj.GetName()).
+		Param("fieldManager", a.fieldManager).
+		Param("force", strconv.FormatBool(force)).
+		Body(body)
+
+	if dryRun {
+		request = request.Param("dryRun", "All")
+	}
+
+	result, err := request.DoRaw()
+	if errors.IsConflict(err) {
+		return nil, conflictError(obj, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	applied := &unstructured.Unstructured{}
+	return applied, applied.UnmarshalJSON(result)
+}
+
+// Convert the conflict returned by the API server when applying obj to a
+// ConflictError listing each conflicting field.
+func conflictError(obj *unstructured.Unstructured, err error) *ConflictError {
+	conflict := &ConflictError{
+		Kind:      obj.GetKind(),
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		Conflicts: []string{},
+	}
+
+	if status, ok := err.(*errors.StatusError); ok && status.ErrStatus.Details != nil {
+		for _, cause := range status.ErrStatus.Details.Causes {
+			conflict.Conflicts = append(conflict.Conflicts, cause.Message)
+		}
+	}
+
+	if len(conflict.Conflicts) == 0 {
+		conflict.Conflicts = append(conflict.Conflicts, err.Error())
+	}
+
+	return conflict
+}
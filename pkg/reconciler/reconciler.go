@@ -4,19 +4,32 @@ import (
 	"context"
 	"fmt"
 	"github.com/justinbarrick/gitops-controller/pkg/config"
+	"github.com/justinbarrick/gitops-controller/pkg/jsonnet"
+	"github.com/justinbarrick/gitops-controller/pkg/kustomize"
 	"github.com/justinbarrick/gitops-controller/pkg/repo"
+	"github.com/justinbarrick/gitops-controller/pkg/status"
 	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"github.com/justinbarrick/gitops-controller/pkg/webhook"
 	ryaml "github.com/justinbarrick/gitops-controller/pkg/yaml"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/openpgp"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/tools/record"
+	"math/rand"
+	"reflect"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	k8sconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/runtime/signals"
 	"sigs.k8s.io/controller-runtime/pkg/source"
@@ -32,13 +45,44 @@ type Source struct {
 
 // Reconciler that synchronizes objects in Kubernetes to a git repository.
 type Reconciler struct {
-	config  *config.Config
-	client  client.Client
-	repo    *repo.Repo
-	mgr     manager.Manager
-	sources []Source
+	config *config.Config
+	client client.Client
+	// Applies objects synced to Kubernetes.
+	applier Applier
+	// Records events on synced objects.
+	recorder record.EventRecorder
+	// The repository objects are synced to Kubernetes from.
+	repo *repo.Repo
+	// The repository objects synced to Git are written to, the same as repo unless
+	// repo is pinned to a revision.
+	writeRepo *repo.Repo
+	mgr       manager.Manager
+	sources   []Source
+	// Uncached client used to read variables, set if variables are substituted.
+	reader    client.Client
+	variables *ryaml.Variables
+	status    *status.Server
+	// Requests to sync from Git immediately, sent when a push webhook is received.
+	syncs chan struct{}
+	// Set once an event has been sent for every object in the repository.
+	synced bool
 }
 
+// How often the repository is polled by default, and how often it is polled by
+// default when webhooks are received.
+const (
+	pollInterval        = 30 * time.Second
+	webhookPollInterval = 5 * time.Minute
+)
+
+// The reasons of the events recorded on synced objects.
+const (
+	ReasonSyncedToGit     = "SyncedToGit"
+	ReasonRestoredFromGit = "RestoredFromGit"
+	ReasonDeletedNotInGit = "DeletedNotInGit"
+	ReasonSyncFailed      = "SyncFailed"
+)
+
 // Create a new reconciler and checkout the repository.
 func NewReconciler(config *config.Config) (*Reconciler, error) {
 	mgr, err := manager.New(k8sconfig.GetConfigOrDie(), manager.Options{
@@ -49,22 +93,383 @@ func NewReconciler(config *config.Config) (*Reconciler, error) {
 		return nil, err
 	}
 
-	repo, err := repo.NewRepo(config.GitURL, config.GitPath, config.Branch)
+	gitRepo, err := openRepo(config, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	r := &Reconciler{
-		config:  config,
-		repo:    repo,
-		mgr:     mgr,
-		client:  mgr.GetClient(),
-		sources: []Source{},
+		config:    config,
+		repo:      gitRepo,
+		writeRepo: gitRepo,
+		mgr:       mgr,
+		client:    mgr.GetClient(),
+		applier:   NewServerSideApplier(mgr.GetConfig(), mgr.GetRESTMapper(), config.FieldManager),
+		recorder:  mgr.GetRecorder("gitops-controller"),
+		sources:   []Source{},
+		status:    status.NewServer(),
+		syncs:     make(chan struct{}, 1),
+	}
+
+	if config.Pin != nil {
+		revision, err := repo.NewRevision(config.Pin.Tag, config.Pin.Commit, config.Pin.Semver)
+		if err != nil {
+			return nil, err
+		}
+
+		r.repo, err = openRepo(config, revision)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.registerStatus(); err != nil {
+		return nil, err
+	}
+
+	if config.ReadsFromCluster() {
+		r.reader, err = client.New(mgr.GetConfig(), client.Options{Scheme: util.Scheme})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.SubstitutesVariables() {
+		if err := r.UpdateVariables(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Encryption != nil {
+		encryption, err := r.LoadEncryption()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, gitRepo := range r.repos() {
+			gitRepo.SetEncryption(encryption)
+		}
+	}
+
+	if config.Redaction != nil {
+		redaction, err := r.LoadRedaction()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, gitRepo := range r.repos() {
+			gitRepo.SetRedaction(redaction)
+		}
+	}
+
+	if config.Verification != nil {
+		verifier, err := r.LoadVerifier()
+		if err != nil {
+			return nil, err
+		}
+
+		signingKey, err := r.LoadSigningKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if signingKey != nil {
+			verifier.Trust(signingKey)
+
+			for _, gitRepo := range r.repos() {
+				gitRepo.SetSigningKey(signingKey)
+			}
+		}
+
+		r.repo.SetVerifier(verifier)
 	}
 
 	return r, r.RegisterReconcilersForRules()
 }
 
+// Clone the repository, checking out revision if it is not nil.
+func openRepo(config *config.Config, revision *repo.Revision) (*repo.Repo, error) {
+	gitRepo, err := repo.NewRepo(config.GitURL, config.GitPath, config.Branch)
+	if err != nil {
+		return nil, err
+	}
+
+	gitRepo.SetRevision(revision)
+	gitRepo.SetFilters(config.Include, config.Exclude)
+	if len(config.ExternalFiles.Fields) != 0 {
+		gitRepo.SetExternalFiles(externalFiles(config.ExternalFiles))
+	}
+	gitRepo.AddGenerator(&kustomize.Generator{})
+	gitRepo.AddGenerator(&jsonnet.Generator{Config: config.Jsonnet})
+
+	return gitRepo, nil
+}
+
+// Return the repositories the reconciler reads from, the pinned repository and the
+// repository written to are both returned if they are different.
+func (r *Reconciler) repos() []*repo.Repo {
+	if r.writeRepo == r.repo {
+		return []*repo.Repo{r.repo}
+	}
+
+	return []*repo.Repo{r.repo, r.writeRepo}
+}
+
+// Convert the configured external fields to the settings used by manifests.
+func externalFiles(external config.ExternalFiles) *ryaml.ExternalFiles {
+	fields := []ryaml.ExternalField{}
+	for _, field := range external.Fields {
+		fields = append(fields, ryaml.ExternalField{
+			Kind:   field.Kind,
+			Path:   field.Path,
+			Binary: field.Binary,
+		})
+	}
+
+	return &ryaml.ExternalFiles{
+		Fields:  fields,
+		MinSize: external.MinSize,
+	}
+}
+
+// Report problems with the repository through the status API and metrics.
+func (r *Reconciler) registerStatus() error {
+	r.status.Register("invalidDocuments", func() interface{} {
+		return r.repo.InvalidDocuments()
+	})
+
+	r.status.Register("duplicateObjects", func() interface{} {
+		return r.repo.Duplicates()
+	})
+
+	r.status.Register("unverifiedCommit", func() interface{} {
+		return r.repo.Unverified()
+	})
+
+	for _, gauge := range []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gitops_controller_invalid_documents",
+			Help: "The number of documents in the repository that could not be loaded.",
+		}, func() float64 {
+			return float64(len(r.repo.InvalidDocuments()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gitops_controller_duplicate_objects",
+			Help: "The number of objects that are defined more than once in the repository.",
+		}, func() float64 {
+			return float64(len(r.repo.Duplicates()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gitops_controller_unverified_commit",
+			Help: "1 if the latest commit is not synced because it is not signed by a trusted key.",
+		}, func() float64 {
+			if r.repo.Unverified() != nil {
+				return 1
+			}
+			return 0
+		}),
+	} {
+		if err := metrics.Registry.Register(gauge); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read the values for placeholders in manifests from the configuration and from
+// the ConfigMaps and Secrets in variablesFrom, in order.
+func (r *Reconciler) LoadVariables() (*ryaml.Variables, error) {
+	values := map[string]string{}
+	for name, value := range r.config.Variables {
+		values[name] = value
+	}
+
+	for _, source := range r.config.VariablesFrom {
+		key := types.NamespacedName{Namespace: source.Namespace, Name: source.Name}
+
+		switch source.Kind {
+		case "ConfigMap":
+			configMap := &corev1.ConfigMap{}
+			if err := r.reader.Get(context.TODO(), key, configMap); err != nil {
+				return nil, err
+			}
+
+			for name, value := range configMap.Data {
+				values[name] = value
+			}
+		case "Secret":
+			secret := &corev1.Secret{}
+			if err := r.reader.Get(context.TODO(), key, secret); err != nil {
+				return nil, err
+			}
+
+			for name, value := range secret.Data {
+				values[name] = string(value)
+			}
+		default:
+			return nil, fmt.Errorf("variablesFrom kind must be ConfigMap or Secret, not %s", source.Kind)
+		}
+	}
+
+	return &ryaml.Variables{
+		Values: values,
+		Strict: r.config.StrictVariables,
+	}, nil
+}
+
+// Reload the variables and, if they changed, reindex the repository with them.
+func (r *Reconciler) UpdateVariables() error {
+	variables, err := r.LoadVariables()
+	if err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(variables, r.variables) {
+		return nil
+	}
+
+	util.Log.Info("variables changed, reindexing", "variables", len(variables.Values))
+	r.variables = variables
+	for _, gitRepo := range r.repos() {
+		gitRepo.SetVariables(variables)
+	}
+	return nil
+}
+
+// Read a key from a Secret. Returns an empty string if ref is nil.
+func (r *Reconciler) ReadSecretKey(ref *config.SecretKeyRef) (string, error) {
+	if ref == nil {
+		return "", nil
+	}
+
+	secret := &corev1.Secret{}
+	key := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+	if err := r.reader.Get(context.TODO(), key, secret); err != nil {
+		return "", err
+	}
+
+	data, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %s", ref.Namespace, ref.Name, ref.Key)
+	}
+
+	return string(data), nil
+}
+
+// Create the receiver for push webhooks, reading the secret webhooks are verified
+// with.
+func (r *Reconciler) NewWebhookReceiver() (*webhook.Receiver, error) {
+	secret, err := r.ReadSecretKey(r.config.Webhook.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty secret would accept webhooks signed by anyone.
+	if secret == "" {
+		return nil, fmt.Errorf("secret %s/%s has an empty webhook secret in key %s", r.config.Webhook.Secret.Namespace,
+			r.config.Webhook.Secret.Name, r.config.Webhook.Secret.Key)
+	}
+
+	return &webhook.Receiver{
+		URL:     r.config.GitURL,
+		Branch:  r.writeRepo.Branch(),
+		Tags:    r.repo.Revision() != nil,
+		Secret:  secret,
+		Trigger: r.TriggerSync,
+	}, nil
+}
+
+// Request a sync from Git. Requests made while a sync is already pending are
+// merged into it.
+func (r *Reconciler) TriggerSync() {
+	select {
+	case r.syncs <- struct{}{}:
+	default:
+	}
+}
+
+// Create the redaction for the repository, reading the salt values are hashed with
+// from saltSecret.
+func (r *Reconciler) LoadRedaction() (*ryaml.Redaction, error) {
+	salt, err := r.ReadSecretKey(r.config.Redaction.SaltSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	if salt == "" {
+		return nil, fmt.Errorf("secret %s/%s has an empty salt in key %s", r.config.Redaction.SaltSecret.Namespace,
+			r.config.Redaction.SaltSecret.Name, r.config.Redaction.SaltSecret.Key)
+	}
+
+	fields := []ryaml.RedactedField{}
+	for _, field := range r.config.Redaction.Fields {
+		fields = append(fields, ryaml.RedactedField{
+			Kind: field.Kind,
+			Path: field.Path,
+		})
+	}
+
+	if len(fields) == 0 {
+		fields = ryaml.DefaultRedactedFields
+	}
+
+	return &ryaml.Redaction{
+		Fields: fields,
+		Salt:   salt,
+	}, nil
+}
+
+// Create the encryption for the repository, reading the age identities used to
+// decrypt values from keySecret.
+func (r *Reconciler) LoadEncryption() (*ryaml.Encryption, error) {
+	identities, err := r.ReadSecretKey(r.config.Encryption.KeySecret)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []ryaml.EncryptedField{}
+	for _, field := range r.config.Encryption.Fields {
+		fields = append(fields, ryaml.EncryptedField{
+			Kind: field.Kind,
+			Path: field.Path,
+		})
+	}
+
+	return ryaml.NewEncryption(r.config.Encryption.Recipients, identities, fields)
+}
+
+// Create the verifier for commits synced to Kubernetes, reading the trusted keys
+// from keyRingSecret and sshKeysSecret.
+func (r *Reconciler) LoadVerifier() (*repo.Verifier, error) {
+	keyRing, err := r.ReadSecretKey(r.config.Verification.KeyRingSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	sshKeys, err := r.ReadSecretKey(r.config.Verification.SSHKeysSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.NewVerifier(keyRing, sshKeys)
+}
+
+// Read the key the controller signs its commits with from signingKeySecret, or
+// return nil if it is not set.
+func (r *Reconciler) LoadSigningKey() (*openpgp.Entity, error) {
+	if r.config.Verification.SigningKeySecret == nil {
+		return nil, nil
+	}
+
+	armored, err := r.ReadSecretKey(r.config.Verification.SigningKeySecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.ReadSigningKey(armored)
+}
+
 // Register the reconciler for each prototype object provided.
 func (r *Reconciler) Register(kinds ...runtime.Object) error {
 	for _, kind := range kinds {
@@ -104,19 +509,29 @@ func (r *Reconciler) ReconcilerForType(kind runtime.Object) reconcile.Func {
 		}
 
 		k8sNotFound := errors.IsNotFound(err)
+		fetched := k8sState
 
-		// Fetch resource from Git.
-		gitState, err := r.repo.FindObjectInRepo(k8sState)
+		k8sState, gitState, rule, err := r.FindObject(r.repo, fetched, k8sNotFound)
 		if err != nil {
 			return reconcile.Result{}, err
 		}
 
-		if k8sNotFound {
-			k8sState = nil
+		// Objects synced to Git are compared with the branch they are written to
+		// rather than with the revision the repository is pinned to, where they may
+		// not exist at all.
+		if r.writeRepo != r.repo && (rule == nil || rule.SyncTo == config.Git) {
+			k8sState, gitState, rule, err = r.FindObject(r.writeRepo, fetched, k8sNotFound)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+
+			if rule != nil && rule.SyncTo != config.Git {
+				return reconcile.Result{}, nil
+			}
 		}
 
-		// If the resource does not exist in either place, return.
-		if k8sState == nil && gitState == nil {
+		// If no rules match, return.
+		if rule == nil {
 			return reconcile.Result{}, nil
 		}
 
@@ -125,21 +540,14 @@ func (r *Reconciler) ReconcilerForType(kind runtime.Object) reconcile.Func {
 			gitStateObj = gitState.Object
 		}
 
-		// Get a rule that matches the object.
-		rule, err := r.config.RuleForObject(k8sState, gitStateObj, false)
-		if err != nil {
-			return reconcile.Result{}, err
-		}
-
-		// If no rules match, return.
-		if rule == nil {
-			return reconcile.Result{}, nil
-		}
-
 		// Check if there are no changes to sync.
 		if gitStateObj != nil && k8sState != nil {
-			patch := admission.PatchResponse(k8sState, gitStateObj)
-			if len(patch.Patches) == 0 {
+			inSync, err := r.InSync(k8sState, gitState, rule)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+
+			if inSync {
 				return reconcile.Result{}, nil
 			}
 		}
@@ -158,32 +566,289 @@ func (r *Reconciler) ReconcilerForType(kind runtime.Object) reconcile.Func {
 	})
 }
 
-// Synchronize the object in a git repository with its actual state in Kubernetes.
-func (r *Reconciler) SyncObjectToGit(k8sState runtime.Object, gitState *ryaml.Object, rule *config.Rule) error {
+// Find an object fetched from Kubernetes in a repository and the rule that matches
+// it. k8sState is returned at the version in Git, or nil if it was not found. The
+// rule is nil if the object should not be synchronized: it is in neither place, no
+// rule matches it, it is defined more than once or it is defined in a path that
+// cannot be loaded.
+func (r *Reconciler) FindObject(gitRepo *repo.Repo, k8sState runtime.Object, k8sNotFound bool) (runtime.Object, *ryaml.Object, *config.Rule, error) {
+	// Fetch resource from Git. Objects that are defined more than once are not
+	// synchronized until only one definition is left.
+	gitState, err := gitRepo.FindObjectInRepo(k8sState)
+	if duplicate, ok := err.(*repo.DuplicateError); ok {
+		meta := util.GetMeta(k8sState)
+		util.Log.Info("not syncing object defined more than once", "kind", util.GetType(k8sState).Kind,
+			"name", meta.GetName(), "namespace", meta.GetNamespace(), "paths", duplicate.Paths)
+		return nil, nil, nil, nil
+	} else if broken, ok := err.(*repo.BrokenError); ok {
+		meta := util.GetMeta(k8sState)
+		util.Log.Info("not syncing object defined in paths that cannot be loaded", "kind",
+			util.GetType(k8sState).Kind, "name", meta.GetName(), "namespace", meta.GetNamespace(),
+			"paths", broken.Paths)
+		return nil, nil, nil, nil
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Objects stored in Git at another version of the same group are compared
+	// at the version in Git.
+	if gitState != nil && !k8sNotFound {
+		k8sState, err = r.ConvertToVersion(k8sState, util.GetType(gitState.Object))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if k8sNotFound {
+		k8sState = nil
+	}
+
+	// If the resource does not exist in either place, return.
+	if k8sState == nil && gitState == nil {
+		return nil, nil, nil, nil
+	}
+
+	var gitStateObj runtime.Object
+	if gitState != nil {
+		gitStateObj = gitState.Object
+	}
+
+	// Get a rule that matches the object.
+	rule, err := r.config.RuleForObject(k8sState, gitStateObj, false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return k8sState, gitState, rule, nil
+}
+
+// Return true if an object in Kubernetes is in sync with its manifest in Git. Both
+// are compared without server-managed metadata and status, and only fields matched
+// by the rule's filters are compared. Equivalent values, such as quantities of the
+// same amount, are in sync. Redacted values are in sync if their hashes match.
+//
+// When syncing to Kubernetes, the object is compared with the result of a
+// server-side dry-run apply of the manifest, so fields defaulted by the API server
+// or owned by other field managers are not differences. If the dry-run fails, only
+// fields in the manifest and fields the controller applied are compared.
+func (r *Reconciler) InSync(k8sState runtime.Object, gitState *ryaml.Object, rule *config.Rule) (bool, error) {
 	var err error
 
+	compared := k8sState
+	if gitState.Redacted() || gitState.File.Redaction != nil {
+		compared, err = gitState.Redact(k8sState)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	desired := gitState.Object
+	managedOnly := rule.SyncTo == config.Kubernetes
+
+	if rule.SyncTo == config.Kubernetes && !gitState.Redacted() {
+		applied, err := rule.ApplyConfiguration(gitState.Object)
+		if err != nil {
+			return false, err
+		}
+
+		dryRun, err := r.applier.Apply(applied, true, true)
+		if err != nil {
+			meta := util.GetMeta(k8sState)
+			util.Log.Info("could not dry-run apply object, comparing with manifest", "kind",
+				util.GetType(k8sState).Kind, "name", meta.GetName(), "namespace", meta.GetNamespace(),
+				"error", err.Error())
+		} else {
+			// The dry-run has the values in Kubernetes rather than their hashes.
+			compared = k8sState
+			desired = dryRun
+			managedOnly = false
+		}
+	}
+
+	compared = util.StripObject(compared)
+
+	patches, err := rule.FilterPatches(admission.PatchResponse(compared, util.StripObject(desired)).Patches)
+	if err != nil {
+		return false, err
+	}
+
+	patches, err = util.SemanticPatches(compared, patches)
+	if err != nil {
+		return false, err
+	}
+
+	if managedOnly {
+		patches = util.ManagedPatches(k8sState, patches, r.config.FieldManager)
+	}
+
+	return len(patches) == 0, nil
+}
+
+// Fetch obj from Kubernetes at another version of its group, letting the API
+// server convert it. Returns obj if it is already at that version.
+func (r *Reconciler) ConvertToVersion(obj runtime.Object, gvk schema.GroupVersionKind) (runtime.Object, error) {
+	current := util.GetType(obj)
+	if current == gvk || current.GroupKind() != gvk.GroupKind() {
+		return obj, nil
+	}
+
+	meta := util.GetMeta(obj)
+	converted := util.DefaultObject(util.Kind(gvk.Kind, gvk.Group, gvk.Version), meta.GetName(), meta.GetNamespace())
+
+	util.Log.Info("converting object to version in git", "kind", gvk.Kind, "name", meta.GetName(),
+		"namespace", meta.GetNamespace(), "from", current.Version, "to", gvk.Version)
+
+	err := r.client.Get(context.TODO(), types.NamespacedName{
+		Name:      meta.GetName(),
+		Namespace: meta.GetNamespace(),
+	}, converted)
+	if err != nil {
+		return nil, err
+	}
+
+	return converted, nil
+}
+
+// Synchronize the object in a git repository with its actual state in Kubernetes.
+func (r *Reconciler) SyncObjectToGit(k8sState runtime.Object, gitState *ryaml.Object, rule *config.Rule) (err error) {
+	// Events are recorded on the object as it is in Kubernetes.
+	synced := k8sState
+	defer func() {
+		r.recordFailure(synced, gitState, err)
+	}()
+
+	// Generated objects can only be changed by changing their source.
+	if gitState != nil && gitState.File.Generator != "" {
+		meta := util.GetMeta(gitState.Object)
+		util.Log.Info("not writing generated object to git", "kind", util.GetType(gitState.Object).Kind,
+			"name", meta.GetName(), "namespace", meta.GetNamespace(),
+			"generator", gitState.File.Generator, "source", gitState.File.Path)
+		return nil
+	}
+
 	if k8sState == nil {
-		err = r.repo.RemoveResource(k8sState, gitState)
-	} else {
-		if gitState != nil {
-			k8sState, err = config.PatchObject(gitState.Object, k8sState, rule)
-			if err != nil {
-				return err
-			}
+		message, err := r.CommitMessage("Removing", gitState.Object, nil, "", rule)
+		if err != nil {
+			return err
+		}
+
+		commit, err := r.writeRepo.RemoveResource(k8sState, gitState, message)
+		if err != nil {
+			return err
+		}
+
+		if commit != "" {
+			r.recorder.Eventf(gitState.Object, corev1.EventTypeNormal, ReasonSyncedToGit,
+				"Removed from Git in commit %s", commit)
+		}
+
+		return nil
+	}
+
+	action := "Adding"
+	var original runtime.Object
+
+	path, err := r.config.RenderPath(rule, k8sState)
+	if err != nil {
+		return err
+	}
+
+	if gitState != nil {
+		action = "Updating"
+		original = gitState.Object
+
+		k8sState, err = config.PatchObject(gitState.Object, k8sState, rule)
+		if err != nil {
+			return err
 		}
+	}
 
-		err = r.repo.AddResource(k8sState, gitState)
+	// Redacted values must not end up in the commit message either, and neither
+	// must the plaintext of encrypted values.
+	messageState := k8sState
+	messageOriginal := original
+	if gitState != nil && (gitState.Redacted() || gitState.File.Redaction != nil) {
+		messageState, err = gitState.Redact(k8sState)
+		if err != nil {
+			return err
+		}
 	}
 
-	return err
+	if gitState != nil {
+		messageState, messageOriginal, err = gitState.MaskEncrypted(messageState)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The manager is read from the live object, since patching it with a rule's
+	// filters drops its metadata.
+	message, err := r.CommitMessage(action, messageState, messageOriginal, util.LastManager(synced), rule)
+	if err != nil {
+		return err
+	}
+
+	commit, err := r.writeRepo.AddResource(k8sState, gitState, path, message)
+	if err != nil {
+		return err
+	}
+
+	if commit != "" {
+		r.recorder.Eventf(synced, corev1.EventTypeNormal, ReasonSyncedToGit, "Synced to Git in commit %s", commit)
+	}
+
+	return nil
+}
+
+// Record a warning event on the synced object if syncing it failed.
+func (r *Reconciler) recordFailure(k8sState runtime.Object, gitState *ryaml.Object, err error) {
+	if err == nil {
+		return
+	}
+
+	obj := k8sState
+	if obj == nil && gitState != nil {
+		obj = gitState.Object
+	}
+
+	if obj != nil {
+		r.recorder.Event(obj, corev1.EventTypeWarning, ReasonSyncFailed, err.Error())
+	}
+}
+
+// Render the commit message for a change to obj made by manager. If original is not
+// nil, the changes between original and obj are included in the message.
+func (r *Reconciler) CommitMessage(action string, obj, original runtime.Object, manager string, rule *config.Rule) (string, error) {
+	meta := util.GetMeta(obj)
+	kind := util.GetType(obj)
+
+	info := config.CommitInfo{
+		Action:    action,
+		Group:     kind.Group,
+		Version:   kind.Version,
+		Kind:      kind.Kind,
+		Namespace: meta.GetNamespace(),
+		Name:      meta.GetName(),
+		Manager:   manager,
+	}
+
+	if original != nil {
+		info.Patch = admission.PatchResponse(util.StripObject(original), util.StripObject(obj)).Patches
+	}
+
+	return r.config.RenderCommitMessage(rule, info)
 }
 
 // Synchronize the object in Kubernetes with its actual state in Git.
-func (r *Reconciler) SyncObjectToKubernetes(k8sState runtime.Object, gitState *ryaml.Object, rule *config.Rule) error {
+func (r *Reconciler) SyncObjectToKubernetes(k8sState runtime.Object, gitState *ryaml.Object, rule *config.Rule) (err error) {
 	if k8sState == nil && gitState == nil {
 		return nil
 	}
 
+	defer func() {
+		r.recordFailure(k8sState, gitState, err)
+	}()
+
 	var logMeta metav1.Object
 	var kind string
 	if k8sState != nil {
@@ -195,29 +860,62 @@ func (r *Reconciler) SyncObjectToKubernetes(k8sState runtime.Object, gitState *r
 	}
 
 	if gitState == nil {
+		// The object may be defined in a path that cannot be loaded, so nothing is
+		// deleted until it is fixed.
+		if paths := r.repo.UnidentifiedPaths(); len(paths) != 0 {
+			return fmt.Errorf("not deleting %s %s/%s while paths cannot be loaded: %s", kind,
+				logMeta.GetNamespace(), logMeta.GetName(), strings.Join(paths, ", "))
+		}
+
 		util.Log.Info("deleting object not in git", "kind", kind, "name",
 			logMeta.GetName(), "namespace", logMeta.GetNamespace())
-		if err := r.client.Delete(context.TODO(), k8sState); err != nil && !errors.IsNotFound(err) {
+		if err := r.client.Delete(context.TODO(), k8sState); errors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
 			return err
 		}
+
+		r.recorder.Event(k8sState, corev1.EventTypeNormal, ReasonDeletedNotInGit, "Deleted because it is not in Git")
+		return nil
+	}
+
+	// The values of redacted objects are not in Git, so restoring them would
+	// overwrite the live values with placeholders.
+	if gitState.Redacted() {
+		util.Log.Info("not restoring object from redacted manifest", "kind", kind, "name",
+			logMeta.GetName(), "namespace", logMeta.GetNamespace(), "path", gitState.File.Path)
 		return nil
 	}
 
 	if k8sState == nil {
 		util.Log.Info("recreating object from git", "kind", kind, "name",
 			logMeta.GetName(), "namespace", logMeta.GetNamespace())
-		return r.client.Create(context.TODO(), gitState.Object)
+	} else {
+		util.Log.Info("restoring object to git state", "kind", kind, "name",
+			logMeta.GetName(), "namespace", logMeta.GetNamespace())
 	}
 
-	util.Log.Info("restoring object to git state", "kind", kind, "name",
-		logMeta.GetName(), "namespace", logMeta.GetNamespace())
-
-	patched, err := config.PatchObject(k8sState, gitState.Object, rule)
+	applied, err := rule.ApplyConfiguration(gitState.Object)
 	if err != nil {
 		return err
 	}
 
-	return r.client.Update(context.TODO(), patched)
+	restored, err := r.applier.Apply(applied, rule.Force, false)
+	if conflict, ok := err.(*ConflictError); ok {
+		util.Log.Info("not restoring object owned by other field managers", "kind", kind, "name",
+			logMeta.GetName(), "namespace", logMeta.GetNamespace(), "conflicts", conflict.Conflicts)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if k8sState == nil {
+		r.recorder.Event(restored, corev1.EventTypeNormal, ReasonRestoredFromGit, "Created from Git")
+	} else {
+		r.recorder.Event(restored, corev1.EventTypeNormal, ReasonRestoredFromGit, "Restored to its state in Git")
+	}
+
+	return nil
 }
 
 // Register a new reconciler of the given type.
@@ -304,51 +1002,135 @@ func (r *Reconciler) RegisterReconcilersForRules() error {
 	return nil
 }
 
-// Synchronize the local repository with the origin and generate an event
-// for each object.
-func (r *Reconciler) GitSync() error {
-	r.repo.Lock()
+// Send an event for an object to the sources watching its kind.
+func (r *Reconciler) enqueue(obj runtime.Object) {
+	kind := util.GetType(obj)
+	meta := util.GetMeta(obj)
 
-	if err := r.repo.Pull(); err != nil {
-		r.repo.Unlock()
-		return err
+	for _, source := range r.sources {
+		sourceKind := util.GetType(source.Kind)
+		if sourceKind.Kind != kind.Kind || sourceKind.Group != kind.Group {
+			continue
+		}
+
+		source.Chan <- event.GenericEvent{
+			Meta:   meta,
+			Object: obj,
+		}
 	}
+}
 
-	objects, err := r.repo.LoadRepoYAMLs()
-	if err != nil {
-		r.repo.Unlock()
-		return err
+// Synchronize the local repository with the origin and generate an event
+// for each object in a file that changed and each object that was removed.
+func (r *Reconciler) GitSync() error {
+	if r.config.SubstitutesVariables() {
+		if err := r.UpdateVariables(); err != nil {
+			return err
+		}
 	}
 
-	r.repo.Unlock()
+	objects := []*ryaml.Object{}
+	deleted := []*ryaml.Object{}
 
-	for _, obj := range objects {
-		kind := util.GetType(obj.Object)
-		meta := util.GetMeta(obj.Object)
+	for _, gitRepo := range r.repos() {
+		gitRepo.Lock()
 
-		for _, source := range r.sources {
-			sourceKind := util.GetType(source.Kind)
-			if sourceKind.Kind != kind.Kind || sourceKind.Group != kind.Group {
-				continue
-			}
+		changed, removed, err := gitRepo.Update()
+		if err != nil {
+			gitRepo.Unlock()
+			return err
+		}
 
-			source.Chan <- event.GenericEvent{
-				Meta:   meta,
-				Object: obj.Object,
+		// Objects that are only in Git are not reconciled until an event is sent for
+		// them, so the first sync sends one for every object.
+		if !r.synced {
+			changed, err = gitRepo.LoadRepoYAMLs()
+			if err != nil {
+				gitRepo.Unlock()
+				return err
 			}
 		}
+
+		gitRepo.Unlock()
+
+		objects = append(objects, changed...)
+		deleted = append(deleted, removed...)
+	}
+
+	r.synced = true
+
+	for _, obj := range objects {
+		r.enqueue(obj.Object)
+	}
+
+	// Removed objects are reconciled against the new state of the repository, which
+	// deletes them from Kubernetes if they are synced to Kubernetes.
+	for _, obj := range deleted {
+		meta := util.GetMeta(obj.Object)
+		util.Log.Info("object removed from git", "kind", util.GetType(obj.Object).Kind,
+			"name", meta.GetName(), "namespace", meta.GetNamespace(), "path", obj.File.Path)
+		r.enqueue(obj.Object)
 	}
 
 	return nil
 }
 
+// Return how long to wait before the next resync, interval plus a random duration up
+// to the configured jitter so that controllers sharing a repository do not all poll
+// it at once.
+func (r *Reconciler) resyncDelay(interval time.Duration) time.Duration {
+	if r.config.ResyncJitter <= 0 {
+		return interval
+	}
+
+	return interval + time.Duration(rand.Int63n(int64(r.config.ResyncJitter)))
+}
+
 // Start the controller.
 func (r *Reconciler) Start() error {
-	ticker := time.NewTicker(30 * time.Second)
 	go func() {
-		for _ = range ticker.C {
-			util.Log.Info("resyncing")
-			r.GitSync()
+		if err := r.status.Start(r.config.StatusAddress); err != nil {
+			util.Log.Error(err, "status server stopped")
+		}
+	}()
+
+	interval := r.config.ResyncInterval
+	if interval == 0 {
+		interval = pollInterval
+	}
+
+	if r.config.Webhook != nil {
+		receiver, err := r.NewWebhookReceiver()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := receiver.Start(r.config.Webhook.Address); err != nil {
+				util.Log.Error(err, "webhook receiver stopped")
+			}
+		}()
+
+		if r.config.ResyncInterval == 0 {
+			interval = webhookPollInterval
+		}
+	}
+
+	// Sync as soon as the controller starts rather than after the first interval.
+	r.TriggerSync()
+
+	go func() {
+		for {
+			select {
+			case <-time.After(r.resyncDelay(interval)):
+				util.Log.Info("resyncing")
+			case <-r.syncs:
+				util.Log.Info("syncing")
+			}
+
+			if err := r.GitSync(); err != nil {
+				util.Log.Error(err, "could not sync from git")
+			}
 		}
 	}()
 	return r.mgr.Start(signals.SetupSignalHandler())
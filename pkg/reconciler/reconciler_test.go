@@ -7,10 +7,14 @@ import (
 	"github.com/justinbarrick/gitops-controller/pkg/util"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strings"
 	"testing"
 )
 
@@ -30,6 +34,49 @@ func labeled(obj runtime.Object) runtime.Object {
 	return obj
 }
 
+// Merge the fields set in src into dst.
+func merge(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+
+		if srcIsMap && dstIsMap {
+			merge(dstMap, srcMap)
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+// Applies objects by merging them into the objects in a client.
+type fakeApplier struct {
+	client client.Client
+}
+
+func (a *fakeApplier) Apply(obj *unstructured.Unstructured, force, dryRun bool) (*unstructured.Unstructured, error) {
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(obj.GroupVersionKind())
+
+	err := a.client.Get(context.TODO(), types.NamespacedName{
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+	}, live)
+	if errors.IsNotFound(err) && dryRun {
+		return obj, nil
+	} else if errors.IsNotFound(err) {
+		return obj, a.client.Create(context.TODO(), obj)
+	} else if err != nil {
+		return nil, err
+	}
+
+	merge(live.Object, obj.Object)
+	if dryRun {
+		return live, nil
+	}
+
+	return live, a.client.Update(context.TODO(), live)
+}
+
 func TestReconciler(t *testing.T) {
 	deployment := util.Kind("Deployment", "extensions", "v1beta1")
 
@@ -42,6 +89,8 @@ func TestReconciler(t *testing.T) {
 		expectedGit runtime.Object
 		expectedK8s runtime.Object
 		rules       []config.Rule
+		// The prefix of an event that is expected to be recorded, if any.
+		expectedEvent string
 	}{
 		{
 			name:        "Git rule adds objects in kubernetes to kubernetes",
@@ -72,6 +121,7 @@ func TestReconciler(t *testing.T) {
 					SyncTo:    config.Kubernetes,
 				},
 			},
+			expectedEvent: "Normal RestoredFromGit Created from Git",
 		},
 		{
 			name:    "Git rule deletes objects missing from kubernetes",
@@ -85,6 +135,7 @@ func TestReconciler(t *testing.T) {
 					SyncTo:    config.Git,
 				},
 			},
+			expectedEvent: "Normal SyncedToGit Removed from Git in commit",
 		},
 		{
 			name:    "Kubernetes rule deletes objects missing from git",
@@ -98,6 +149,7 @@ func TestReconciler(t *testing.T) {
 					SyncTo:    config.Kubernetes,
 				},
 			},
+			expectedEvent: "Normal DeletedNotInGit",
 		},
 		{
 			name:        "Git rule updates out of date objects from kubernetes",
@@ -114,6 +166,7 @@ func TestReconciler(t *testing.T) {
 					SyncTo:    config.Git,
 				},
 			},
+			expectedEvent: "Normal SyncedToGit Synced to Git in commit",
 		},
 		{
 			name:        "Kubernetes rule updates out of date objects from git repository",
@@ -130,6 +183,23 @@ func TestReconciler(t *testing.T) {
 					SyncTo:    config.Kubernetes,
 				},
 			},
+			expectedEvent: "Normal RestoredFromGit Restored to its state in Git",
+		},
+		{
+			name:        "Kubernetes rule keeps fields that are not in git",
+			kind:        deployment,
+			testObj:     types.NamespacedName{"hello", "test"},
+			initGit:     labeled(util.DefaultObject(deployment, "test", "hello")),
+			initK8s:     annotated(labeled(util.DefaultObject(deployment, "test", "hello"))),
+			expectedK8s: annotated(labeled(util.DefaultObject(deployment, "test", "hello"))),
+			expectedGit: labeled(util.DefaultObject(deployment, "test", "hello")),
+			rules: []config.Rule{
+				config.Rule{
+					Resources: []string{"deployments"},
+					APIGroups: []string{"extensions"},
+					SyncTo:    config.Kubernetes,
+				},
+			},
 		},
 		{
 			name:        "First rule is applied",
@@ -226,7 +296,7 @@ func TestReconciler(t *testing.T) {
 
 			// If initGit is not nil, add initGit to the repo.
 			if test.initGit != nil {
-				err = repo.AddResource(test.initGit, nil)
+				_, err = repo.AddResource(test.initGit, nil, "", "")
 				assert.Nil(t, err)
 			}
 
@@ -237,10 +307,14 @@ func TestReconciler(t *testing.T) {
 				initObjs = append(initObjs, test.initK8s)
 			}
 			client := fake.NewFakeClient(initObjs...)
+			recorder := record.NewFakeRecorder(100)
 
 			reconciler := &Reconciler{
-				client: client,
-				repo:   repo,
+				client:    client,
+				applier:   &fakeApplier{client},
+				recorder:  recorder,
+				repo:      repo,
+				writeRepo: repo,
 				config: &config.Config{
 					Rules: test.rules,
 				},
@@ -278,6 +352,26 @@ func TestReconciler(t *testing.T) {
 				assert.Nil(t, err)
 				assert.Equal(t, test.expectedK8s, actual)
 			}
+
+			if test.expectedEvent == "" {
+				return
+			}
+
+			close(recorder.Events)
+
+			recorded := []string{}
+			for event := range recorder.Events {
+				recorded = append(recorded, event)
+			}
+
+			found := false
+			for _, event := range recorded {
+				if strings.HasPrefix(event, test.expectedEvent) {
+					found = true
+				}
+			}
+
+			assert.True(t, found, "expected event %s, got %v", test.expectedEvent, recorded)
 		})
 	}
 }
@@ -0,0 +1,154 @@
+package repo
+
+import (
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"github.com/justinbarrick/gitops-controller/pkg/yaml"
+	"gopkg.in/src-d/go-billy.v4"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"strings"
+)
+
+// A source in the repository that a generator renders into objects.
+type Source struct {
+	// The path of the source, relative to the root of the repository.
+	Path string
+	// The files and directories that the source is rendered from. They are not
+	// loaded as plain manifests and the source is rendered again when any of them
+	// change.
+	Inputs []string
+}
+
+// Return true if path is one of the source's inputs or is inside of one of them.
+func (s Source) Claims(path string) bool {
+	for _, input := range s.Inputs {
+		if path == input || strings.HasPrefix(path, input+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Renders sources in the repository that are not plain manifests, such as
+// kustomizations, into objects. Generated objects are read-only.
+type Generator interface {
+	// The name of the generator, used in log messages and errors.
+	Name() string
+	// Find all of the sources in workDir that the generator can render.
+	Find(fs billy.Filesystem, workDir string) ([]Source, error)
+	// Render a source into objects.
+	Render(fs billy.Filesystem, source Source) ([]*unstructured.Unstructured, error)
+}
+
+// A source along with the generator that renders it.
+type generatedSource struct {
+	Source
+	generator Generator
+}
+
+// Register a generator for non-manifest sources in the repository.
+func (r *Repo) AddGenerator(generator Generator) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	r.generators = append(r.generators, generator)
+	r.index = nil
+}
+
+// Find the sources of every registered generator, skipping sources that are
+// ignored.
+func (r *Repo) findSources() ([]generatedSource, error) {
+	sources := []generatedSource{}
+
+	for _, generator := range r.generators {
+		found, err := generator.Find(r.fs, r.workDir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, source := range found {
+			if r.isIgnored(source.Path, false) {
+				continue
+			}
+
+			sources = append(sources, generatedSource{source, generator})
+		}
+	}
+
+	return sources, nil
+}
+
+// Return true if path is an input of any generated source.
+func (r *Repo) isGeneratorInput(path string) bool {
+	for _, source := range r.sources {
+		if source.Claims(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Render a source and add its objects to the index. If the source cannot be
+// rendered, it is recorded as invalid and the objects it rendered before are
+// recorded as broken rather than removed.
+func (r *Repo) renderSource(index *Index, source generatedSource) {
+	rendered, err := source.generator.Render(r.fs, source.Source)
+	if err != nil {
+		util.Log.Error(err, "skipping source that could not be rendered", "generator",
+			source.generator.Name(), "path", source.Path)
+
+		previous, known := indexedKeys(index, source.Path)
+
+		index.SetFile(source.Path, nil)
+		index.SetInvalid(source.Path, []*yaml.InvalidDocument{
+			&yaml.InvalidDocument{
+				Path:  source.Path,
+				Error: err.Error(),
+			},
+		})
+		index.SetBroken(source.Path, previous, !known)
+		return
+	}
+
+	index.SetInvalid(source.Path, nil)
+	index.SetBroken(source.Path, nil, false)
+
+	file := yaml.NewFile(r.fs, source.Path)
+	file.Generator = source.generator.Name()
+
+	objects := []*yaml.Object{}
+	for _, obj := range rendered {
+		object := &yaml.Object{
+			File:   file,
+			Object: obj,
+		}
+
+		file.Objects = append(file.Objects, object)
+		objects = append(objects, object)
+	}
+
+	util.Log.Info("rendered source", "generator", file.Generator, "path", source.Path,
+		"objects", len(objects))
+	index.SetFile(source.Path, objects)
+}
+
+// Return true if two lists of sources have the same paths.
+func sameSources(a, b []generatedSource) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	paths := map[string]bool{}
+	for _, source := range a {
+		paths[source.Path] = true
+	}
+
+	for _, source := range b {
+		if !paths[source.Path] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The name of the files listing paths, in gitignore syntax, that are not loaded as
+// manifests. The patterns in an ignore file apply to the directory it is in and
+// every directory below it.
+const IgnoreFile = ".gitopsignore"
+
+// Split a path relative to the root of the repository into its components.
+func splitPath(path string) []string {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." || path == "/" {
+		return []string{}
+	}
+
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// Set glob patterns, in gitignore syntax and relative to the working directory,
+// that select the files to load as manifests. If include is not empty, only files
+// that match one of its patterns are loaded. Files and directories matching a
+// pattern in exclude are skipped.
+func (r *Repo) SetFilters(include, exclude []string) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	domain := splitPath(r.workDir)
+
+	r.include = nil
+	for _, pattern := range include {
+		r.include = append(r.include, gitignore.ParsePattern(pattern, domain))
+	}
+
+	r.exclude = nil
+	for _, pattern := range exclude {
+		r.exclude = append(r.exclude, gitignore.ParsePattern(pattern, domain))
+	}
+
+	r.index = nil
+}
+
+// Forget the patterns of the ignore files that have been read, so that they are read
+// again when they are next needed. Called whenever the index is built, which
+// happens whenever an ignore file changes.
+func (r *Repo) clearIgnoreFiles() {
+	r.ignoreLock.Lock()
+	defer r.ignoreLock.Unlock()
+
+	r.ignores = nil
+}
+
+// Return the patterns in the ignore file in dir, reading it if it has not been read
+// since the index was last built.
+func (r *Repo) ignoreFile(dir []string) ([]gitignore.Pattern, error) {
+	path := filepath.Join(filepath.Join(dir...), IgnoreFile)
+
+	r.ignoreLock.Lock()
+	defer r.ignoreLock.Unlock()
+
+	if patterns, ok := r.ignores[path]; ok {
+		return patterns, nil
+	}
+
+	patterns, err := r.readIgnoreFile(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.ignores == nil {
+		r.ignores = map[string][]gitignore.Pattern{}
+	}
+
+	r.ignores[path] = patterns
+	return patterns, nil
+}
+
+// Read the patterns in the ignore file in dir.
+func (r *Repo) readIgnoreFile(dir []string) ([]gitignore.Pattern, error) {
+	data, err := util.ReadFile(r.fs, filepath.Join(filepath.Join(dir...), IgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	patterns := []gitignore.Pattern{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		patterns = append(patterns, gitignore.ParsePattern(line, dir))
+	}
+
+	return patterns, nil
+}
+
+// Return true if path, relative to the root of the repository, is ignored by an
+// ignore file or an exclude pattern.
+func (r *Repo) isIgnored(path string, isDir bool) bool {
+	components := splitPath(path)
+	if len(components) == 0 {
+		return false
+	}
+
+	// Ignore files closer to path take precedence, so they are added last.
+	patterns := []gitignore.Pattern{}
+	for i := 0; i < len(components); i++ {
+		// The patterns keep dir as their domain, so it must not share components'
+		// backing array.
+		dir := components[:i:i]
+
+		filePatterns, err := r.ignoreFile(dir)
+		if err != nil {
+			util.Log.Error(err, "could not read ignore file", "path",
+				filepath.Join(filepath.Join(dir...), IgnoreFile))
+			continue
+		}
+
+		patterns = append(patterns, filePatterns...)
+	}
+
+	patterns = append(patterns, r.exclude...)
+
+	return gitignore.NewMatcher(patterns).Match(components, isDir)
+}
+
+// Return true if the file at path matches the include patterns, or if there are
+// none.
+func (r *Repo) isIncluded(path string) bool {
+	if len(r.include) == 0 {
+		return true
+	}
+
+	return gitignore.NewMatcher(r.include).Match(splitPath(path), false)
+}
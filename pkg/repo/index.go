@@ -0,0 +1,390 @@
+package repo
+
+import (
+	"fmt"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"github.com/justinbarrick/gitops-controller/pkg/yaml"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Uniquely identifies an object in the repository.
+type ObjectKey struct {
+	Group     string `json:"group"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// An object that is defined more than once in the repository.
+type Duplicate struct {
+	Key ObjectKey `json:"key"`
+	// The paths of the files the object is defined in.
+	Paths []string `json:"paths"`
+}
+
+// Returned when looking up an object that is defined more than once, since it is
+// ambiguous which definition should be used.
+type DuplicateError struct {
+	Duplicate
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("%s/%s/%s is defined more than once: %s", e.Key.Kind, e.Key.Namespace,
+		e.Key.Name, strings.Join(e.Paths, ", "))
+}
+
+// Returned when looking up an object that is defined in a file or generated
+// source that cannot currently be loaded, since its definition is unknown.
+type BrokenError struct {
+	Key ObjectKey
+	// The paths that defined the object and can no longer be loaded.
+	Paths []string
+}
+
+func (e *BrokenError) Error() string {
+	return fmt.Sprintf("%s/%s/%s is defined in paths that cannot be loaded: %s", e.Key.Kind,
+		e.Key.Namespace, e.Key.Name, strings.Join(e.Paths, ", "))
+}
+
+// Return the key for an object.
+func KeyForObject(obj runtime.Object) ObjectKey {
+	meta := util.GetMeta(obj)
+	kind := util.GetType(obj)
+
+	return ObjectKey{
+		Group:     kind.Group,
+		Kind:      kind.Kind,
+		Namespace: meta.GetNamespace(),
+		Name:      meta.GetName(),
+	}
+}
+
+// In-memory index of the objects in the repository so that lookups do not need
+// to load every file in the repository.
+type Index struct {
+	lock    sync.RWMutex
+	objects map[ObjectKey]*yaml.Object
+	files   map[string][]*yaml.Object
+	invalid map[string][]*yaml.InvalidDocument
+	// The paths of the files each object is defined in.
+	paths map[ObjectKey][]string
+	// The manifest that references each file holding fields of its objects.
+	external map[string]string
+	// The objects defined by each path that could not be loaded, and the paths
+	// that could not be loaded without knowing which objects they define.
+	broken       map[string][]ObjectKey
+	unidentified map[string]bool
+}
+
+// Create a new, empty index.
+func NewIndex() *Index {
+	return &Index{
+		objects:      map[ObjectKey]*yaml.Object{},
+		files:        map[string][]*yaml.Object{},
+		invalid:      map[string][]*yaml.InvalidDocument{},
+		paths:        map[ObjectKey][]string{},
+		external:     map[string]string{},
+		broken:       map[string][]ObjectKey{},
+		unidentified: map[string]bool{},
+	}
+}
+
+// Return the object matching key, or nil if it is not in the index.
+func (i *Index) Get(key ObjectKey) *yaml.Object {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.objects[key]
+}
+
+// Return every object in the index, ordered by file path.
+func (i *Index) Objects() []*yaml.Object {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	paths := []string{}
+	for path := range i.files {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	objects := []*yaml.Object{}
+	for _, path := range paths {
+		objects = append(objects, i.files[path]...)
+	}
+
+	return objects
+}
+
+// Return the objects indexed for a file.
+func (i *Index) File(path string) []*yaml.Object {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.files[path]
+}
+
+// Replace the objects indexed for a file. If objects is empty, the file is removed
+// from the index.
+func (i *Index) SetFile(path string, objects []*yaml.Object) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	removed := []ObjectKey{}
+
+	for _, obj := range i.files[path] {
+		key := KeyForObject(obj.Object)
+		if i.objects[key] == obj {
+			delete(i.objects, key)
+			removed = append(removed, key)
+		}
+
+		i.removePath(key, path)
+	}
+
+	if len(objects) == 0 {
+		delete(i.files, path)
+	} else {
+		i.files[path] = objects
+	}
+
+	for _, obj := range objects {
+		key := KeyForObject(obj.Object)
+		if _, ok := i.objects[key]; !ok {
+			i.objects[key] = obj
+		}
+
+		i.paths[key] = append(i.paths[key], path)
+		if len(i.paths[key]) > 1 {
+			util.Log.Info("object is defined more than once", "kind", key.Kind, "name", key.Name,
+				"namespace", key.Namespace, "paths", i.paths[key])
+		}
+	}
+
+	// If another file defines an object that was removed, it takes its place.
+	for _, key := range removed {
+		if _, ok := i.objects[key]; ok {
+			continue
+		}
+
+		for _, objects := range i.files {
+			for _, obj := range objects {
+				if KeyForObject(obj.Object) == key {
+					i.objects[key] = obj
+				}
+			}
+		}
+	}
+}
+
+// Replace the invalid documents recorded for a file.
+func (i *Index) SetInvalid(path string, invalid []*yaml.InvalidDocument) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if len(invalid) == 0 {
+		delete(i.invalid, path)
+	} else {
+		i.invalid[path] = invalid
+	}
+}
+
+// Record the objects defined by path that could not be loaded and whether there
+// may be others that could not be identified. Objects that are loaded from path are
+// never broken.
+func (i *Index) SetBroken(path string, keys []ObjectKey, unidentified bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	loaded := map[ObjectKey]bool{}
+	for _, obj := range i.files[path] {
+		loaded[KeyForObject(obj.Object)] = true
+	}
+
+	broken := []ObjectKey{}
+	for _, key := range keys {
+		if !loaded[key] {
+			broken = append(broken, key)
+		}
+	}
+
+	if len(broken) == 0 {
+		delete(i.broken, path)
+	} else {
+		i.broken[path] = broken
+	}
+
+	if unidentified {
+		i.unidentified[path] = true
+	} else {
+		delete(i.unidentified, path)
+	}
+}
+
+// Return the keys of the objects that path defined but that could not be loaded.
+func (i *Index) BrokenKeys(path string) []ObjectKey {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.broken[path]
+}
+
+// Return true if path could not be loaded and the objects it defines are unknown.
+func (i *Index) IsUnidentified(path string) bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.unidentified[path]
+}
+
+// Return the paths that define key but could not be loaded, sorted.
+func (i *Index) Broken(key ObjectKey) []string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	paths := []string{}
+	for path, keys := range i.broken {
+		for _, broken := range keys {
+			if broken == key {
+				paths = append(paths, path)
+				break
+			}
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// Return the paths that could not be loaded without knowing which objects they
+// define, sorted. Any object that is not in the index may be defined in them.
+func (i *Index) Unidentified() []string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	paths := []string{}
+	for path := range i.unidentified {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// Return true if path has invalid documents or could not be rendered.
+func (i *Index) IsInvalid(path string) bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return len(i.invalid[path]) != 0
+}
+
+// Replace the files that hold fields of the objects in the manifest at path.
+func (i *Index) SetExternal(path string, files []string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	for file, manifest := range i.external {
+		if manifest == path {
+			delete(i.external, file)
+		}
+	}
+
+	for _, file := range files {
+		i.external[file] = path
+	}
+}
+
+// Return the path of the manifest that references the file at path, or an empty
+// string if the file is not referenced.
+func (i *Index) ExternalOwner(path string) string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.external[path]
+}
+
+// Return every invalid document in the index, ordered by file path.
+func (i *Index) Invalid() []*yaml.InvalidDocument {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	paths := []string{}
+	for path := range i.invalid {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	invalid := []*yaml.InvalidDocument{}
+	for _, path := range paths {
+		invalid = append(invalid, i.invalid[path]...)
+	}
+
+	return invalid
+}
+
+// Remove one occurrence of path from the paths of key. Must be called with the lock
+// held.
+func (i *Index) removePath(key ObjectKey, path string) {
+	paths := i.paths[key]
+
+	for n, existing := range paths {
+		if existing == path {
+			paths = append(paths[:n:n], paths[n+1:]...)
+			break
+		}
+	}
+
+	if len(paths) == 0 {
+		delete(i.paths, key)
+	} else {
+		i.paths[key] = paths
+	}
+}
+
+// Return the paths of the files an object is defined in, sorted.
+func (i *Index) Paths(key ObjectKey) []string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	paths := append([]string{}, i.paths[key]...)
+	sort.Strings(paths)
+	return paths
+}
+
+// Return every object that is defined more than once, ordered by the first file it
+// is defined in.
+func (i *Index) Duplicates() []Duplicate {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	duplicates := []Duplicate{}
+	for key, paths := range i.paths {
+		if len(paths) < 2 {
+			continue
+		}
+
+		sorted := append([]string{}, paths...)
+		sort.Strings(sorted)
+
+		duplicates = append(duplicates, Duplicate{
+			Key:   key,
+			Paths: sorted,
+		})
+	}
+
+	sort.Slice(duplicates, func(a, b int) bool {
+		if duplicates[a].Paths[0] != duplicates[b].Paths[0] {
+			return duplicates[a].Paths[0] < duplicates[b].Paths[0]
+		}
+
+		return duplicates[a].Key.Name < duplicates[b].Key.Name
+	})
+
+	return duplicates
+}
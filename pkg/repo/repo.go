@@ -1,22 +1,26 @@
 package repo
 
 import (
+	"errors"
 	"fmt"
 	"github.com/justinbarrick/gitops-controller/pkg/util"
 	"github.com/justinbarrick/gitops-controller/pkg/yaml"
 	"gopkg.in/src-d/go-git.v4"
 	"strings"
 
+	"golang.org/x/crypto/openpgp"
 	"gopkg.in/src-d/go-billy.v4"
 	"gopkg.in/src-d/go-billy.v4/memfs"
 	gitconfig "gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/storage/memory"
 	"k8s.io/apimachinery/pkg/runtime"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
@@ -30,6 +34,44 @@ type Repo struct {
 	workDir string
 	repoDir string
 	branch  string
+	// The index is built on first use and updated as files change.
+	index     *Index
+	indexLock sync.Mutex
+	// Generators for non-manifest sources and the sources they last found.
+	generators []Generator
+	sources    []generatedSource
+	// Variables substituted into manifests, if any.
+	variables *yaml.Variables
+	// Patterns selecting the files that are loaded as manifests.
+	include []gitignore.Pattern
+	exclude []gitignore.Pattern
+	// The patterns of the ignore files read since the index was last built, by
+	// directory.
+	ignores    map[string][]gitignore.Pattern
+	ignoreLock sync.Mutex
+	// Fields written to separate files next to their manifest, if any.
+	external *yaml.ExternalFiles
+	// Encrypts and decrypts fields of manifests, if set.
+	encryption *yaml.Encryption
+	// Redacts fields of manifests, if set.
+	redaction *yaml.Redaction
+	// The objects in the repository after the last update, nil before the first.
+	updated map[ObjectKey]*yaml.Object
+	// The revision checked out instead of the head of the branch, if set.
+	revision *Revision
+	// The hash of the remote reference that was last pulled.
+	pulled plumbing.Hash
+	// Verifies the commits that are checked out, if set.
+	verifier *Verifier
+	// Signs the commits made by the controller, if set.
+	signingKey *openpgp.Entity
+	// True if the checked out commit was verified, or committed on top of one that
+	// was.
+	trusted bool
+	// The commit that was not checked out because it could not be verified, and the
+	// hash of the remote reference that pointed to it.
+	unverified    *UnverifiedError
+	unverifiedRef plumbing.Hash
 }
 
 // Open a git repository, if repoDir is an empty string, it will initialize a
@@ -95,16 +137,17 @@ func (r *Repo) IsClean() (bool, error) {
 }
 
 // Commit staged changes to git, does nothing if there are no changes.
-// Pushes any staged changes.
-func (r *Repo) Commit(message string) error {
+// Pushes any staged changes. Returns the SHA of the commit, or an empty string if
+// there were no changes.
+func (r *Repo) Commit(message string) (string, error) {
 	clean, err := r.IsClean()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// nothing to do
 	if clean {
-		return nil
+		return "", nil
 	}
 
 	commitId, err := r.tree.Commit(message, &git.CommitOptions{
@@ -113,14 +156,19 @@ func (r *Repo) Commit(message string) error {
 			Email: "test@test.com",
 			When:  time.Now(),
 		},
+		SignKey: r.signingKey,
 	})
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	util.Log.Info("commited", "commit", commitId.String(), "message", message)
 
-	return r.Push()
+	if err := r.Push(); err != nil {
+		return "", err
+	}
+
+	return commitId.String(), nil
 }
 
 // Add a file to the repository.
@@ -129,6 +177,8 @@ func (r *Repo) Add(path string) error {
 	return err
 }
 
+// Call cb for every file under path, skipping files and directories that are
+// ignored and files that do not match the include patterns.
 func (r *Repo) Walk(path string, cb func(string, os.FileInfo) error) error {
 	files, err := r.fs.ReadDir(path)
 	if err != nil {
@@ -138,9 +188,13 @@ func (r *Repo) Walk(path string, cb func(string, os.FileInfo) error) error {
 	for _, file := range files {
 		fullPath := filepath.Join(path, file.Name())
 
+		if r.isIgnored(fullPath, file.IsDir()) {
+			continue
+		}
+
 		if file.IsDir() {
 			err = r.Walk(fullPath, cb)
-		} else {
+		} else if r.isIncluded(fullPath) {
 			err = cb(fullPath, file)
 		}
 
@@ -152,96 +206,606 @@ func (r *Repo) Walk(path string, cb func(string, os.FileInfo) error) error {
 	return nil
 }
 
-// Load all YAML files in a repository.
-func (r *Repo) LoadRepoYAMLs() ([]*yaml.Object, error) {
-	mappings := []*yaml.Object{}
-
+// Return true if the file at path should be loaded as a manifest.
+func (r *Repo) isManifest(path string) bool {
 	allowedExtensions := map[string]bool{
 		".yaml": true,
 		".yml":  true,
 		".json": true,
 	}
 
-	return mappings, r.Walk(r.workDir, func(path string, info os.FileInfo) error {
-		if !allowedExtensions[filepath.Ext(path)] {
+	if !allowedExtensions[filepath.Ext(path)] {
+		return false
+	}
+
+	rel, err := filepath.Rel(r.workDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+
+	return r.isIncluded(path) && !r.isIgnored(path, false)
+}
+
+// Set the variables substituted into manifests when they are loaded. If variables
+// is nil, manifests are loaded as is.
+func (r *Repo) SetVariables(variables *yaml.Variables) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	r.variables = variables
+	r.index = nil
+}
+
+// Set the fields that are written to separate files next to their manifest. If
+// external is nil, every field is written to the manifest.
+func (r *Repo) SetExternalFiles(external *yaml.ExternalFiles) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	r.external = external
+	r.index = nil
+}
+
+// Set the encryption used to decrypt manifests when they are loaded and to encrypt
+// them when they are written. If encryption is nil, manifests with encrypted values
+// cannot be loaded.
+func (r *Repo) SetEncryption(encryption *yaml.Encryption) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	r.encryption = encryption
+	r.index = nil
+}
+
+// Set the redaction used when manifests are written. If redaction is nil, values
+// are only redacted where they are already redacted in Git.
+func (r *Repo) SetRedaction(redaction *yaml.Redaction) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	r.redaction = redaction
+	r.index = nil
+}
+
+// Only check out commits that verifier verifies. Until a verified commit has been
+// pulled, the repository cannot be read from.
+func (r *Repo) SetVerifier(verifier *Verifier) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	r.verifier = verifier
+	r.trusted = false
+	r.index = nil
+}
+
+// Sign the commits made to the repository with key, so that they can be verified
+// when they are checked out again, such as after a restart. If key is nil, commits
+// are not signed.
+func (r *Repo) SetSigningKey(key *openpgp.Entity) {
+	r.signingKey = key
+}
+
+// Return the commit that was not checked out because it could not be verified, or
+// nil if the latest commit was checked out.
+func (r *Repo) Unverified() *UnverifiedError {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	return r.unverified
+}
+
+// Record whether the latest commit could be checked out.
+func (r *Repo) setUnverified(unverified *UnverifiedError, ref plumbing.Hash) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	r.unverified = unverified
+	r.unverifiedRef = ref
+
+	if unverified == nil {
+		r.trusted = true
+	}
+}
+
+// Return true if the checked out commit can be read from.
+func (r *Repo) isTrusted() bool {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	return r.verifier == nil || r.trusted
+}
+
+// Check out revision instead of the head of the branch. A repository pinned to a
+// revision cannot be written to.
+func (r *Repo) SetRevision(revision *Revision) {
+	r.revision = revision
+}
+
+// Create a file that substitutes the repository's variables, redacts and encrypts
+// fields and writes fields to separate files.
+func (r *Repo) newFile(path string) *yaml.File {
+	file := yaml.NewFile(r.fs, path)
+	file.Variables = r.variables
+	file.Redaction = r.redaction
+	file.Encryption = r.encryption
+	file.External = r.external
+	return file
+}
+
+// Load the objects in a single file into the index, recording any invalid
+// documents and the files that hold fields of its objects. Those files are not
+// manifests, so they are removed from the index if they were loaded as one.
+//
+// While any document in the file is invalid, the objects the file defined before
+// may be defined by it, so they are recorded as broken rather than removed.
+func (r *Repo) loadFile(index *Index, path string) error {
+	file := r.newFile(path)
+	if _, err := file.Load(); err != nil {
+		return err
+	}
+
+	previous, known := indexedKeys(index, path)
+
+	index.SetFile(path, file.Objects)
+	index.SetInvalid(path, file.Invalid)
+	index.SetExternal(path, file.ExternalFiles())
+
+	broken := []ObjectKey{}
+	unidentified := false
+
+	if len(file.Invalid) != 0 {
+		broken = previous
+	}
+
+	for _, invalid := range file.Invalid {
+		if invalid.Objects == nil {
+			unidentified = unidentified || !known
+			continue
+		}
+
+		for _, obj := range invalid.Objects {
+			broken = append(broken, KeyForObject(obj))
+		}
+	}
+
+	index.SetBroken(path, broken, unidentified)
+
+	for _, external := range file.ExternalFiles() {
+		index.SetFile(external, nil)
+		index.SetInvalid(external, nil)
+		index.SetBroken(external, nil, false)
+	}
+
+	return nil
+}
+
+// Return the keys of the objects that path defined the last time it was indexed,
+// including those that could not be loaded, and true if they are all known.
+func indexedKeys(index *Index, path string) ([]ObjectKey, bool) {
+	keys := append([]ObjectKey{}, index.BrokenKeys(path)...)
+	for _, obj := range index.File(path) {
+		keys = append(keys, KeyForObject(obj.Object))
+	}
+
+	return keys, len(keys) != 0 && !index.IsUnidentified(path)
+}
+
+// Return the paths that could not be loaded without knowing which objects they
+// define. Objects that are not in the repository may be defined in them.
+func (r *Repo) UnidentifiedPaths() []string {
+	r.indexLock.Lock()
+	index := r.index
+	r.indexLock.Unlock()
+
+	if index == nil {
+		return []string{}
+	}
+
+	return index.Unidentified()
+}
+
+// Return the documents in the repository that could not be loaded.
+func (r *Repo) InvalidDocuments() []*yaml.InvalidDocument {
+	r.indexLock.Lock()
+	index := r.index
+	r.indexLock.Unlock()
+
+	if index == nil {
+		return []*yaml.InvalidDocument{}
+	}
+
+	return index.Invalid()
+}
+
+// Return the index of the repository, building it if it has not been built yet.
+func (r *Repo) getIndex() (*Index, error) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	if r.index != nil {
+		return r.index, nil
+	}
+
+	if r.verifier != nil && !r.trusted {
+		return nil, errors.New("no verified commit has been checked out")
+	}
+
+	return r.buildIndex()
+}
+
+// Load every manifest and render every generated source in the repository into a
+// new index. Must be called with the index lock held.
+func (r *Repo) buildIndex() (*Index, error) {
+	util.Log.Info("indexing repo", "repo", r.repoDir)
+	startTime := time.Now()
+
+	r.clearIgnoreFiles()
+
+	sources, err := r.findSources()
+	if err != nil {
+		return nil, err
+	}
+
+	r.sources = sources
+
+	index := NewIndex()
+
+	err = r.Walk(r.workDir, func(path string, info os.FileInfo) error {
+		if !r.isManifest(path) || r.isGeneratorInput(path) || index.ExternalOwner(path) != "" {
+			return nil
+		}
+
+		return r.loadFile(index, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, source := range sources {
+		r.renderSource(index, source)
+	}
+
+	duration := time.Now().Sub(startTime).Seconds()
+	util.Log.Info("indexed repo", "repo", r.repoDir, "duration", duration)
+
+	r.index = index
+	return index, nil
+}
+
+// Reload the objects in the files at paths into the index. Files that no longer
+// exist are removed from the index and generated sources that read from any of the
+// files are rendered again. Does nothing if the index has not been built.
+func (r *Repo) reindexFiles(paths ...string) error {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	// Changing an ignore file can change which files are manifests, building the
+	// index reads the ignore files again.
+	for _, path := range paths {
+		if filepath.Base(path) != IgnoreFile {
+			continue
+		}
+
+		if r.index == nil {
+			r.clearIgnoreFiles()
 			return nil
 		}
 
-		file := yaml.NewFile(r.fs, path)
+		_, err := r.buildIndex()
+		return err
+	}
+
+	if r.index == nil {
+		return nil
+	}
 
-		objects, err := file.Load()
+	if len(r.generators) != 0 {
+		sources, err := r.findSources()
 		if err != nil {
 			return err
 		}
 
-		mappings = append(mappings, objects...)
-		return nil
-	})
+		// Sources were added or removed, so the set of plain manifests has changed
+		// too.
+		if !sameSources(sources, r.sources) {
+			_, err := r.buildIndex()
+			return err
+		}
+
+		r.sources = sources
+
+		for _, source := range sources {
+			for _, path := range paths {
+				if !source.Claims(path) {
+					continue
+				}
+
+				r.renderSource(r.index, source)
+
+				break
+			}
+		}
+	}
+
+	for _, path := range paths {
+		// Changing a file that holds fields of objects reloads their manifest.
+		if manifest := r.index.ExternalOwner(path); manifest != "" {
+			path = manifest
+		}
+
+		if !r.isManifest(path) || r.isGeneratorInput(path) {
+			continue
+		}
+
+		if _, err := r.fs.Stat(path); os.IsNotExist(err) {
+			r.index.SetFile(path, nil)
+			r.index.SetInvalid(path, nil)
+			r.index.SetExternal(path, nil)
+			r.index.SetBroken(path, nil, false)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := r.loadFile(r.index, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// Search the repository for any files that have a matching object, returning a
-// yaml.Object. Returns nil if the object is not found in the repository.
-func (r *Repo) FindObjectInRepo(obj runtime.Object) (*yaml.Object, error) {
-	var found *yaml.Object
+// Return the paths of all files that differ between two commits. If from is the
+// zero hash, every file in to is returned.
+func (r *Repo) changedFiles(from, to plumbing.Hash) ([]string, error) {
+	var fromTree, toTree *object.Tree
+
+	for _, commit := range []struct {
+		hash plumbing.Hash
+		tree **object.Tree
+	}{
+		{from, &fromTree},
+		{to, &toTree},
+	} {
+		if commit.hash.IsZero() {
+			continue
+		}
 
-	objectMappings, err := r.LoadRepoYAMLs()
+		c, err := r.repo.CommitObject(commit.hash)
+		if err != nil {
+			return nil, err
+		}
+
+		*commit.tree, err = c.Tree()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := object.DiffTree(fromTree, toTree)
 	if err != nil {
-		return found, err
+		return nil, err
 	}
 
-	for _, objMapping := range objectMappings {
-		if !objMapping.Matches(obj) {
-			continue
+	paths := []string{}
+	for _, change := range changes {
+		if change.From.Name != "" {
+			paths = append(paths, change.From.Name)
 		}
 
-		found = objMapping
-		break
+		if change.To.Name != "" && change.To.Name != change.From.Name {
+			paths = append(paths, change.To.Name)
+		}
+	}
+
+	return paths, nil
+}
+
+// Return the hash of the currently checked out commit, or the zero hash if there
+// are no commits.
+func (r *Repo) head() (plumbing.Hash, error) {
+	ref, err := r.repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return ref.Hash(), nil
+}
+
+// Load all YAML files in a repository.
+func (r *Repo) LoadRepoYAMLs() ([]*yaml.Object, error) {
+	index, err := r.getIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return index.Objects(), nil
+}
+
+// Search the repository for any files that have a matching object, returning a
+// yaml.Object. Returns nil if the object is not found in the repository, a
+// *DuplicateError if it is defined more than once and a *BrokenError if it is only
+// defined in paths that cannot currently be loaded.
+func (r *Repo) FindObjectInRepo(obj runtime.Object) (*yaml.Object, error) {
+	index, err := r.getIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	key := KeyForObject(obj)
+	if paths := index.Paths(key); len(paths) > 1 {
+		return nil, &DuplicateError{Duplicate{Key: key, Paths: paths}}
+	}
+
+	found := index.Get(key)
+	if found == nil {
+		if paths := index.Broken(key); len(paths) != 0 {
+			return nil, &BrokenError{Key: key, Paths: paths}
+		}
 	}
 
 	return found, nil
 }
 
+// Return every object that is defined more than once in the repository.
+func (r *Repo) Duplicates() []Duplicate {
+	r.indexLock.Lock()
+	index := r.index
+	r.indexLock.Unlock()
+
+	if index == nil {
+		return []Duplicate{}
+	}
+
+	return index.Duplicates()
+}
+
+// Open the file at path, loading any objects that are already in it. The file is
+// always loaded again rather than taken from the index, so that changing it does not
+// change the index until it has been written and reindexed.
+func (r *Repo) openFile(path string) (*yaml.File, error) {
+	r.indexLock.Lock()
+	file := r.newFile(path)
+	r.indexLock.Unlock()
+
+	if _, err := r.fs.Stat(path); os.IsNotExist(err) {
+		return file, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Load(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Load a copy of the object with the same key as obj from the file at path, see
+// openFile.
+func (r *Repo) loadObject(path string, obj runtime.Object) (*yaml.Object, error) {
+	file, err := r.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := KeyForObject(obj)
+	for _, loaded := range file.Objects {
+		if KeyForObject(loaded.Object) == key {
+			return loaded, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s no longer contains %s/%s/%s", path, key.Kind, key.Namespace, key.Name)
+}
+
 // Add an object to a repository - if it exists in the repository already, update
-// it in place, if not, create a new file and write it to that file.
-func (r *Repo) AddResource(obj runtime.Object, found *yaml.Object) error {
+// it in place, if not, add it to the file at path, relative to the working
+// directory. If path is empty, the object is written to
+// <namespace>/<Kind>/<name>.yaml. If message is empty, a default commit message is
+// used. Returns the SHA of the commit, or an empty string if nothing changed.
+func (r *Repo) AddResource(obj runtime.Object, found *yaml.Object, path, message string) (string, error) {
 	r.Lock()
 	defer r.Unlock()
 
+	if err := r.writable(); err != nil {
+		return "", err
+	}
+
 	found, err := r.FindObjectInRepo(obj)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if found != nil && found.File.Generator != "" {
+		return "", &yaml.GeneratedError{Path: found.File.Path, Generator: found.File.Generator}
 	}
 
 	action := "Updating"
 
-	if found == nil {
+	if found != nil {
+		found, err = r.loadObject(found.File.Path, obj)
+		if err != nil {
+			return "", err
+		}
+	} else {
 		action = "Adding"
 
 		meta := util.GetMeta(obj)
 		kind := util.GetType(obj)
 
-		fname := fmt.Sprintf("%s.yaml", meta.GetName())
-		gitPath := filepath.Join(r.workDir, meta.GetNamespace(), kind.Kind, fname)
+		if path == "" {
+			path = filepath.Join(meta.GetNamespace(), kind.Kind, fmt.Sprintf("%s.yaml", meta.GetName()))
+		}
+
+		gitPath := filepath.Join(r.workDir, path)
+		if !r.isManifest(gitPath) {
+			return "", fmt.Errorf("path %s is not a YAML or JSON file inside of %s", gitPath, r.workDir)
+		}
 
-		found = &yaml.Object{}
+		if r.isGeneratorInput(gitPath) {
+			return "", fmt.Errorf("path %s is an input of a generated source", gitPath)
+		}
+
+		file, err := r.openFile(gitPath)
+		if err != nil {
+			return "", err
+		}
+
+		found = &yaml.Object{Object: obj}
 
-		file := yaml.NewFile(r.fs, gitPath)
 		file.AddResource(found)
+		if found.File == nil {
+			return "", fmt.Errorf("%s already contains %s/%s/%s", gitPath, kind.Kind,
+				meta.GetNamespace(), meta.GetName())
+		}
 	}
 
 	found.SetObject(obj)
 	if err := found.Save(); err != nil {
-		return err
+		return "", err
 	}
 
-	if err := r.Add(found.File.Path); err != nil {
-		return err
+	if err := r.reindexFiles(found.File.Path); err != nil {
+		return "", err
+	}
+
+	for _, path := range append(found.File.ChangedFiles(), found.File.Path) {
+		if err := r.Add(path); err != nil {
+			return "", err
+		}
+	}
+
+	if message == "" {
+		meta := util.GetMeta(obj)
+		kind := util.GetType(obj)
+
+		message = fmt.Sprintf("%s resource %s/%s/%s", action, kind.Kind, meta.GetNamespace(), meta.GetName())
 	}
 
-	meta := util.GetMeta(obj)
-	kind := util.GetType(obj)
+	return r.Commit(message)
+}
+
+// Return the branch the repository is checked out at.
+func (r *Repo) Branch() string {
+	return r.branch
+}
+
+// Return the revision the repository is pinned to, or nil if it follows its branch.
+func (r *Repo) Revision() *Revision {
+	return r.revision
+}
+
+// Return an error if the repository is pinned to a revision, since there is no
+// branch to push commits to.
+func (r *Repo) writable() error {
+	if r.revision != nil {
+		return fmt.Errorf("cannot write to repository pinned to %s", r.revision)
+	}
 
-	return r.Commit(fmt.Sprintf("%s resource %s/%s/%s", action, kind.Kind, meta.GetNamespace(), meta.GetName()))
+	return nil
 }
 
 func (r *Repo) Lock() {
@@ -252,29 +816,55 @@ func (r *Repo) Unlock() {
 	r.lock.Unlock()
 }
 
-// Remove an object from the repository if it exists.
-func (r *Repo) RemoveResource(obj runtime.Object, found *yaml.Object) error {
+// Remove an object from the repository if it exists. If message is empty, a
+// default commit message is used. Returns the SHA of the commit, or an empty string
+// if nothing changed.
+func (r *Repo) RemoveResource(obj runtime.Object, found *yaml.Object, message string) (string, error) {
 	r.Lock()
 	defer r.Unlock()
 
+	if err := r.writable(); err != nil {
+		return "", err
+	}
+
 	if found == nil {
-		return nil
+		return "", nil
+	}
+
+	if found.File.Generator != "" {
+		return "", &yaml.GeneratedError{Path: found.File.Path, Generator: found.File.Generator}
+	}
+
+	found, err := r.loadObject(found.File.Path, found.Object)
+	if err != nil {
+		return "", err
 	}
 
-	path := found.File.Path
+	file := found.File
+	path := file.Path
 
 	if err := found.Delete(); err != nil {
-		return err
+		return "", err
 	}
 
-	if err := r.Add(path); err != nil {
-		return err
+	if err := r.reindexFiles(path); err != nil {
+		return "", err
+	}
+
+	for _, path := range append(file.ChangedFiles(), path) {
+		if err := r.Add(path); err != nil {
+			return "", err
+		}
 	}
 
-	meta := util.GetMeta(found.Object)
-	kind := util.GetType(found.Object)
+	if message == "" {
+		meta := util.GetMeta(found.Object)
+		kind := util.GetType(found.Object)
 
-	return r.Commit(fmt.Sprintf("Removing resource %s/%s/%s", kind.Kind, meta.GetNamespace(), meta.GetName()))
+		message = fmt.Sprintf("Removing resource %s/%s/%s", kind.Kind, meta.GetNamespace(), meta.GetName())
+	}
+
+	return r.Commit(message)
 }
 
 // Push any staged commits to the Git repository. If pushing fails due to an out of
@@ -308,45 +898,316 @@ func (r *Repo) Push() error {
 	return git.ErrNonFastForwardUpdate
 }
 
-// Update the local checkout with the latest version from the remote.
+// Return the reference on the remote that is checked out without fetching it: the
+// branch, or the tag or commit the repository is pinned to. A branch that does not
+// exist has the zero hash.
+func (r *Repo) remoteRef() (*plumbing.Reference, error) {
+	if r.revision != nil && r.revision.Commit != "" {
+		return r.revision.resolve(nil)
+	}
+
+	remote, err := r.repo.Remote("origin")
+	if err != nil {
+		return nil, err
+	}
+
+	branch := plumbing.NewBranchReferenceName(r.branch)
+
+	refs, err := remote.List(&git.ListOptions{})
+	if err == transport.ErrEmptyRemoteRepository && r.revision == nil {
+		return plumbing.NewHashReference(branch, plumbing.ZeroHash), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if r.revision != nil {
+		return r.revision.resolve(refs)
+	}
+
+	for _, ref := range refs {
+		if ref.Name() == branch {
+			return ref, nil
+		}
+	}
+
+	return plumbing.NewHashReference(branch, plumbing.ZeroHash), nil
+}
+
+// Return the ref specs that fetch a reference from the remote. Commits are fetched
+// with every branch and tag, since a commit cannot be fetched by itself.
+func (r *Repo) refSpecs(ref *plumbing.Reference) []gitconfig.RefSpec {
+	switch {
+	case ref.Name().IsBranch():
+		return []gitconfig.RefSpec{
+			gitconfig.RefSpec(fmt.Sprintf("+%s:refs/remotes/origin/%s", ref.Name(), ref.Name().Short())),
+		}
+	case ref.Name().IsTag():
+		return []gitconfig.RefSpec{
+			gitconfig.RefSpec(fmt.Sprintf("+%s:%s", ref.Name(), ref.Name())),
+		}
+	}
+
+	return []gitconfig.RefSpec{
+		"+refs/heads/*:refs/remotes/origin/*",
+		"+refs/tags/*:refs/tags/*",
+	}
+}
+
+// Return the commit a reference points to once it has been fetched.
+func (r *Repo) fetchedCommit(ref *plumbing.Reference) (plumbing.Hash, error) {
+	hash := ref.Hash()
+
+	if ref.Name().IsBranch() {
+		local, err := r.repo.Reference(plumbing.ReferenceName("refs/remotes/origin/"+ref.Name().Short()), false)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		hash = local.Hash()
+	}
+
+	// Annotated tags point to a tag object rather than to a commit.
+	if tag, err := r.repo.TagObject(hash); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		return commit.Hash, nil
+	} else if err != plumbing.ErrObjectNotFound {
+		return plumbing.ZeroHash, err
+	}
+
+	if _, err := r.repo.CommitObject(hash); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("could not find commit %s: %s", hash, err)
+	}
+
+	return hash, nil
+}
+
+// Pull the latest version from the remote, returning the objects that were loaded
+// again because their files changed and the objects whose documents or files were
+// removed by the pulled commits. Objects in files or generated sources that cannot
+// be loaded are never returned as removed. If the index has not been built yet,
+// every object is returned as changed. Must be called with the repository locked.
+func (r *Repo) Update() ([]*yaml.Object, []*yaml.Object, error) {
+	r.indexLock.Lock()
+	index := r.index
+	r.indexLock.Unlock()
+
+	previous := map[*yaml.Object]bool{}
+	if index != nil {
+		for _, obj := range index.Objects() {
+			previous[obj] = true
+		}
+	}
+
+	pulled, err := r.pull()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	objects, err := r.LoadRepoYAMLs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index, err = r.getIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Files that were reloaded have new objects, even if they are equal.
+	changed := []*yaml.Object{}
+	updated := map[ObjectKey]*yaml.Object{}
+
+	for _, obj := range objects {
+		if !previous[obj] {
+			changed = append(changed, obj)
+		}
+
+		updated[KeyForObject(obj.Object)] = obj
+	}
+
+	deleted := []*yaml.Object{}
+	for key, obj := range r.updated {
+		if updated[key] != nil || len(index.Broken(key)) != 0 || index.IsInvalid(obj.File.Path) {
+			continue
+		}
+
+		if removedBy(obj.File.Path, pulled, index) {
+			deleted = append(deleted, obj)
+		}
+	}
+
+	sort.Slice(deleted, func(i, j int) bool {
+		return deleted[i].File.Path < deleted[j].File.Path
+	})
+
+	r.updated = updated
+	return changed, deleted, nil
+}
+
+// Return true if a change to one of the paths could have removed an object defined
+// at path: the path itself, an input of the source at path or a file holding
+// fields of its objects.
+func removedBy(path string, changed []string, index *Index) bool {
+	for _, changedPath := range changed {
+		if changedPath == path || strings.HasPrefix(changedPath, path+"/") ||
+			index.ExternalOwner(changedPath) == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Update the local checkout with the latest version from the remote, or with the
+// revision the repository is pinned to.
 func (r *Repo) Pull() error {
+	_, err := r.pull()
+	return err
+}
+
+// Pull the latest version and return the paths of the files that changed.
+func (r *Repo) pull() ([]string, error) {
 	if r.repoDir == "" {
-		return nil
+		return nil, nil
 	}
 
-	util.Log.Info("fetching", "repo", r.repoDir)
-	startTime := time.Now()
+	oldHead, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := r.remoteRef()
+	if err != nil {
+		return nil, err
+	}
 
-	remoteRefName := fmt.Sprintf("refs/remotes/origin/%s", r.branch)
-	refSpec := fmt.Sprintf("+refs/heads/%s:%s", r.branch, remoteRefName)
+	trusted := r.isTrusted()
 
-	err := r.repo.Fetch(&git.FetchOptions{
+	if !oldHead.IsZero() && trusted && (ref.Hash() == oldHead || ref.Hash() == r.pulled) {
+		util.Log.Info("remote unchanged", "repo", r.repoDir, "commit", ref.Hash().String())
+		return nil, nil
+	}
+
+	// Commits that could not be verified are not fetched again until the remote
+	// changes.
+	if unverified := r.Unverified(); unverified != nil && ref.Hash() == r.unverifiedRef {
+		return nil, unverified
+	}
+
+	util.Log.Info("fetching", "repo", r.repoDir, "ref", ref.Name().String())
+	startTime := time.Now()
+
+	err = r.repo.Fetch(&git.FetchOptions{
 		RemoteName: "origin",
-		RefSpecs: []gitconfig.RefSpec{
-			gitconfig.RefSpec(refSpec),
-		},
+		RefSpecs:   r.refSpecs(ref),
 	})
 
 	duration := time.Now().Sub(startTime).Seconds()
 	util.Log.Info("fetched", "duration", duration, "repo", r.repoDir)
 
-	if err == git.NoErrAlreadyUpToDate {
-		return nil
+	if err == git.NoErrAlreadyUpToDate && r.revision == nil && trusted {
+		return nil, nil
+	} else if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
 	}
 
-	remoteRef, err := r.repo.Reference(plumbing.ReferenceName(remoteRefName), false)
+	newHead, err := r.fetchedCommit(ref)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := r.verify(newHead); err != nil {
+		util.Log.Info("not checking out unverified commit", "repo", r.repoDir, "commit", newHead.String(),
+			"reason", err.Error())
+		unverified := &UnverifiedError{Commit: newHead.String(), Reason: err.Error()}
+		r.setUnverified(unverified, ref.Hash())
+
+		// A new clone, such as after a restart, has the unverified commit checked
+		// out, so go back to the last verified commit before it.
+		if !trusted {
+			if err := r.checkoutVerified(newHead); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, unverified
+	}
+
+	if newHead != oldHead {
+		util.Log.Info("reset", "repo", r.repoDir, "commit", newHead.String())
+		err = r.tree.Reset(&git.ResetOptions{
+			Commit: newHead,
+			Mode:   git.HardReset,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changed, err := r.changedFiles(oldHead, newHead)
+	if err != nil {
+		return nil, err
+	}
+
+	r.pulled = ref.Hash()
+	r.setUnverified(nil, plumbing.ZeroHash)
+	return changed, r.reindexFiles(changed...)
+}
+
+// Check out the most recent verified commit in the first parent history of hash. If
+// there is none, nothing can be read from the repository until a verified commit
+// is pulled.
+func (r *Repo) checkoutVerified(hash plumbing.Hash) error {
+	for {
+		commit, err := r.repo.CommitObject(hash)
+		if err == plumbing.ErrObjectNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if r.verifier.Verify(commit) == nil {
+			break
+		}
+
+		if commit.NumParents() == 0 {
+			return nil
+		}
+
+		hash = commit.ParentHashes[0]
 	}
 
-	util.Log.Info("reset", "repo", r.repoDir, "commit", remoteRef.Hash().String())
-	err = r.tree.Reset(&git.ResetOptions{
-		Commit: remoteRef.Hash(),
+	util.Log.Info("reset to last verified commit", "repo", r.repoDir, "commit", hash.String())
+	err := r.tree.Reset(&git.ResetOptions{
+		Commit: hash,
 		Mode:   git.HardReset,
 	})
 	if err != nil {
 		return err
 	}
 
-	return err
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	r.trusted = true
+	r.index = nil
+	return nil
+}
+
+// Return an error if the verifier is set and does not verify the commit.
+func (r *Repo) verify(hash plumbing.Hash) error {
+	if r.verifier == nil {
+		return nil
+	}
+
+	commit, err := r.repo.CommitObject(hash)
+	if err != nil {
+		return err
+	}
+
+	return r.verifier.Verify(commit)
 }
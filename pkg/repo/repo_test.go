@@ -1,9 +1,17 @@
 package repo
 
 import (
+	"fmt"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"github.com/justinbarrick/gitops-controller/pkg/yaml"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4"
 	"gopkg.in/src-d/go-billy.v4/osfs"
+	billyutil "gopkg.in/src-d/go-billy.v4/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	//"gopkg.in/src-d/go-billy.v4/memfs"
 	"gopkg.in/src-d/go-git.v4"
@@ -30,7 +38,7 @@ func doCommit(path, text string, r *Repo) (string, error) {
 		return "", err
 	}
 
-	err = r.Commit("a commit")
+	_, err = r.Commit("a commit")
 	if err != nil {
 		return "", err
 	}
@@ -95,3 +103,525 @@ func TestCommitIsAtomic(t *testing.T) {
 	sort.Strings(commits)
 	assert.Equal(t, expectedCommits, commits)
 }
+
+func TestIndexUpdatedOnPull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitops-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	_, err = git.Init(store, nil)
+	assert.Nil(t, err)
+
+	deployment := util.Kind("Deployment", "extensions", "v1beta1")
+	obj := util.DefaultObject(deployment, "test", "hello")
+
+	r1, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+
+	_, err = doCommit("README.md", "manifests", r1)
+	assert.Nil(t, err)
+
+	r2, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+
+	found, err := r2.FindObjectInRepo(obj)
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	commit, err := r1.AddResource(obj, nil, "", "")
+	assert.Nil(t, err)
+
+	head, err := r1.head()
+	assert.Nil(t, err)
+	assert.Equal(t, head.String(), commit)
+
+	found, err = r1.FindObjectInRepo(obj)
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	// Nothing is committed if the object did not change.
+	commit, err = r1.AddResource(obj, found, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "", commit)
+
+	assert.Nil(t, r2.Pull())
+
+	found, err = r2.FindObjectInRepo(obj)
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	found, err = r1.FindObjectInRepo(obj)
+	assert.Nil(t, err)
+	_, err = r1.RemoveResource(obj, found, "")
+	assert.Nil(t, err)
+	assert.Nil(t, r2.Pull())
+
+	found, err = r2.FindObjectInRepo(obj)
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+}
+
+func TestUpdateReturnsChangedAndDeletedObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitops-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	_, err = git.Init(store, nil)
+	assert.Nil(t, err)
+
+	deployment := util.Kind("Deployment", "extensions", "v1beta1")
+	hello := util.DefaultObject(deployment, "hello", "default")
+	world := util.DefaultObject(deployment, "world", "default")
+
+	r1, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+
+	_, err = r1.AddResource(hello, nil, "hello.yaml", "")
+	assert.Nil(t, err)
+	_, err = r1.AddResource(world, nil, "world.yaml", "")
+	assert.Nil(t, err)
+
+	r2, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+
+	names := func(objects []*yaml.Object) []string {
+		names := []string{}
+		for _, obj := range objects {
+			names = append(names, util.GetMeta(obj.Object).GetName())
+		}
+		return names
+	}
+
+	// Every object is returned the first time.
+	changed, deleted, err := r2.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hello", "world"}, names(changed))
+	assert.Equal(t, []string{}, names(deleted))
+
+	changed, deleted, err = r2.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, names(changed))
+	assert.Equal(t, []string{}, names(deleted))
+
+	util.GetMeta(world).SetLabels(map[string]string{"hello": "world"})
+	found, err := r1.FindObjectInRepo(world)
+	assert.Nil(t, err)
+	_, err = r1.AddResource(world, found, "", "")
+	assert.Nil(t, err)
+
+	changed, deleted, err = r2.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"world"}, names(changed))
+	assert.Equal(t, []string{}, names(deleted))
+
+	found, err = r1.FindObjectInRepo(hello)
+	assert.Nil(t, err)
+	_, err = r1.RemoveResource(hello, found, "")
+	assert.Nil(t, err)
+
+	changed, deleted, err = r2.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, names(changed))
+	assert.Equal(t, []string{"hello"}, names(deleted))
+
+	// Objects in files that cannot be loaded are not removed.
+	_, err = doCommit("world.yaml", "kind: [\n", r1)
+	assert.Nil(t, err)
+
+	changed, deleted, err = r2.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, names(changed))
+	assert.Equal(t, []string{}, names(deleted))
+
+	// Neither are objects that are no longer loaded because the filters changed.
+	_, err = r1.AddResource(hello, nil, "hello.yaml", "")
+	assert.Nil(t, err)
+
+	changed, deleted, err = r2.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hello"}, names(changed))
+
+	r2.SetFilters(nil, []string{"hello.yaml"})
+
+	changed, deleted, err = r2.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, names(deleted))
+}
+
+func TestIndexIsGroupAware(t *testing.T) {
+	r, err := NewRepo("", "", "")
+	assert.Nil(t, err)
+
+	extensions := util.DefaultObject(util.Kind("Ingress", "extensions", "v1beta1"), "test", "hello")
+	networking := util.DefaultObject(util.Kind("Ingress", "networking.k8s.io", "v1beta1"), "test", "hello")
+
+	_, err = r.AddResource(extensions, nil, "", "")
+	assert.Nil(t, err)
+
+	found, err := r.FindObjectInRepo(networking)
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	found, err = r.FindObjectInRepo(extensions)
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+}
+
+func TestAddResourceToPath(t *testing.T) {
+	r, err := NewRepo("", "manifests", "")
+	assert.Nil(t, err)
+
+	deployment := util.DefaultObject(util.Kind("Deployment", "apps", "v1"), "test", "hello")
+	service := util.DefaultObject(util.Kind("Service", "", "v1"), "test", "hello")
+
+	_, err = r.AddResource(deployment, nil, "apps/test.yaml", "")
+	assert.Nil(t, err)
+	_, err = r.AddResource(service, nil, "apps/test.yaml", "")
+	assert.Nil(t, err)
+
+	objects, err := yaml.NewFile(r.fs, "manifests/apps/test.yaml").Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(objects))
+
+	_, err = r.AddResource(util.DefaultObject(service, "other", "hello"), nil, "../test.yaml", "")
+	assert.NotNil(t, err)
+}
+
+// Generator that renders a ConfigMap for every file named generate.txt.
+type testGenerator struct{}
+
+func (g *testGenerator) Name() string {
+	return "test"
+}
+
+func (g *testGenerator) Find(fs billy.Filesystem, workDir string) ([]Source, error) {
+	sources := []Source{}
+
+	err := util.WalkAll(fs, workDir, func(path string, info os.FileInfo) error {
+		if info.Name() == "generate.txt" {
+			sources = append(sources, Source{
+				Path:   filepath.Dir(path),
+				Inputs: []string{filepath.Dir(path)},
+			})
+		}
+		return nil
+	})
+
+	return sources, err
+}
+
+func (g *testGenerator) Render(fs billy.Filesystem, source Source) ([]*unstructured.Unstructured, error) {
+	data, err := util.ReadFile(fs, filepath.Join(source.Path, "generate.txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(string(data))
+	if name == "" {
+		return nil, fmt.Errorf("%s/generate.txt is empty", source.Path)
+	}
+
+	obj := util.DefaultObject(util.Kind("ConfigMap", "", "v1"), name, "default")
+	return []*unstructured.Unstructured{obj.(*unstructured.Unstructured)}, nil
+}
+
+func TestGeneratedSources(t *testing.T) {
+	r, err := NewRepo("", "", "")
+	assert.Nil(t, err)
+
+	r.AddGenerator(&testGenerator{})
+
+	configMap := util.Kind("ConfigMap", "", "v1")
+
+	_, err = doCommit("app/generate.txt", "first", r)
+	assert.Nil(t, err)
+
+	// Manifests inside of a generated source are inputs, not objects.
+	_, err = doCommit("app/ignored.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: ignored\n  namespace: default\n", r)
+	assert.Nil(t, err)
+
+	found, err := r.FindObjectInRepo(util.DefaultObject(configMap, "first", "default"))
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	found, err = r.FindObjectInRepo(util.DefaultObject(configMap, "ignored", "default"))
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	// Generated objects cannot be written to.
+	_, err = r.AddResource(util.DefaultObject(configMap, "first", "default"), nil, "", "")
+	assert.NotNil(t, err)
+	_, ok := err.(*yaml.GeneratedError)
+	assert.Equal(t, true, ok)
+
+	// Changing an input renders the source again.
+	file, err := r.fs.Create("app/generate.txt")
+	assert.Nil(t, err)
+	file.Write([]byte("second"))
+	file.Close()
+	assert.Nil(t, r.reindexFiles("app/generate.txt"))
+
+	found, err = r.FindObjectInRepo(util.DefaultObject(configMap, "first", "default"))
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	found, err = r.FindObjectInRepo(util.DefaultObject(configMap, "second", "default"))
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	// Removing the source turns its inputs back into manifests.
+	assert.Nil(t, r.fs.Remove("app/generate.txt"))
+	assert.Nil(t, r.reindexFiles("app/generate.txt"))
+
+	found, err = r.FindObjectInRepo(util.DefaultObject(configMap, "ignored", "default"))
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+}
+
+func TestIgnoredFiles(t *testing.T) {
+	r, err := NewRepo("", "manifests", "")
+	assert.Nil(t, err)
+
+	configMap := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+`
+
+	for path, contents := range map[string]string{
+		".gitopsignore":                   "ci/\n",
+		"manifests/.gitopsignore":         "*.example.yaml\n",
+		"manifests/apps/.gitopsignore":    "values.yaml\n",
+		"manifests/apps/app.yaml":         fmt.Sprintf(configMap, "app"),
+		"manifests/apps/values.yaml":      "replicas: 3\n",
+		"manifests/apps/app.example.yaml": fmt.Sprintf(configMap, "example"),
+		"manifests/ci/pipeline.yaml":      "steps: []\n",
+		"manifests/docs/readme.yaml":      fmt.Sprintf(configMap, "docs"),
+		"manifests/other/values.yaml":     fmt.Sprintf(configMap, "other"),
+	} {
+		assert.Nil(t, billyutil.WriteFile(r.fs, path, []byte(contents), 0644))
+	}
+
+	r.SetFilters(nil, []string{"docs/"})
+
+	names := func() []string {
+		objects, err := r.LoadRepoYAMLs()
+		assert.Nil(t, err)
+
+		names := []string{}
+		for _, obj := range objects {
+			names = append(names, obj.Name())
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"app", "other"}, names())
+
+	r.SetFilters([]string{"apps/**"}, nil)
+	assert.Equal(t, []string{"app"}, names())
+
+	// Ignore files are read once per index build, including ones that do not exist.
+	_, read := r.ignores["manifests/other/.gitopsignore"]
+	assert.True(t, read)
+	assert.Equal(t, 1, len(r.ignores["manifests/apps/.gitopsignore"]))
+
+	// Changing an ignore file reads it again.
+	assert.Nil(t, billyutil.WriteFile(r.fs, "manifests/apps/.gitopsignore", []byte("values.yaml\napp.yaml\n"), 0644))
+	assert.Nil(t, r.reindexFiles("manifests/apps/.gitopsignore"))
+	assert.Equal(t, []string{}, names())
+	assert.Equal(t, 2, len(r.ignores["manifests/apps/.gitopsignore"]))
+}
+
+func TestInvalidDocumentsSkipped(t *testing.T) {
+	r, err := NewRepo("", "", "")
+	assert.Nil(t, err)
+
+	assert.Nil(t, billyutil.WriteFile(r.fs, "broken.yaml", []byte("kind: [\n"), 0644))
+	_, err = r.AddResource(util.DefaultObject(util.Kind("ConfigMap", "", "v1"), "test", "hello"), nil, "", "")
+	assert.Nil(t, err)
+
+	objects, err := r.LoadRepoYAMLs()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+
+	invalid := r.InvalidDocuments()
+	assert.Equal(t, 1, len(invalid))
+	assert.Equal(t, "broken.yaml", invalid[0].Path)
+	assert.Equal(t, 1, invalid[0].Line)
+
+	assert.Nil(t, r.fs.Remove("broken.yaml"))
+	assert.Nil(t, r.reindexFiles("broken.yaml"))
+	assert.Equal(t, 0, len(r.InvalidDocuments()))
+}
+
+func TestBrokenPathsKeepObjects(t *testing.T) {
+	r, err := NewRepo("", "", "")
+	assert.Nil(t, err)
+
+	r.AddGenerator(&testGenerator{})
+
+	configMap := util.Kind("ConfigMap", "", "v1")
+	manifests := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n"
+
+	assert.Nil(t, billyutil.WriteFile(r.fs, "file.yaml", []byte(manifests), 0644))
+	assert.Nil(t, billyutil.WriteFile(r.fs, "app/generate.txt", []byte("generated"), 0644))
+
+	found, err := r.FindObjectInRepo(util.DefaultObject(configMap, "b", ""))
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	// Objects in a document that becomes invalid are broken, not removed.
+	broken := strings.Replace(manifests, "name: b", "name: [b", 1)
+	assert.Nil(t, billyutil.WriteFile(r.fs, "file.yaml", []byte(broken), 0644))
+	assert.Nil(t, r.reindexFiles("file.yaml"))
+
+	found, err = r.FindObjectInRepo(util.DefaultObject(configMap, "a", ""))
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	_, err = r.FindObjectInRepo(util.DefaultObject(configMap, "b", ""))
+	brokenErr, ok := err.(*BrokenError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"file.yaml"}, brokenErr.Paths)
+	assert.Equal(t, []string{}, r.UnidentifiedPaths())
+
+	_, err = r.AddResource(util.DefaultObject(configMap, "b", ""), nil, "", "")
+	assert.NotNil(t, err)
+
+	// So are the objects of a source that can no longer be rendered.
+	assert.Nil(t, billyutil.WriteFile(r.fs, "app/generate.txt", []byte{}, 0644))
+	assert.Nil(t, r.reindexFiles("app/generate.txt"))
+
+	_, err = r.FindObjectInRepo(util.DefaultObject(configMap, "generated", "default"))
+	brokenErr, ok = err.(*BrokenError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"app"}, brokenErr.Paths)
+
+	// Fixing a file loads its objects again.
+	assert.Nil(t, billyutil.WriteFile(r.fs, "file.yaml", []byte(manifests), 0644))
+	assert.Nil(t, r.reindexFiles("file.yaml"))
+
+	found, err = r.FindObjectInRepo(util.DefaultObject(configMap, "b", ""))
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	// Files that are broken when they are first loaded could define any object.
+	assert.Nil(t, billyutil.WriteFile(r.fs, "new.yaml", []byte("kind: [\n"), 0644))
+	assert.Nil(t, r.reindexFiles("new.yaml"))
+	assert.Equal(t, []string{"new.yaml"}, r.UnidentifiedPaths())
+
+	assert.Nil(t, r.fs.Remove("new.yaml"))
+	assert.Nil(t, r.reindexFiles("new.yaml"))
+	assert.Equal(t, []string{}, r.UnidentifiedPaths())
+}
+
+func TestDuplicateObjects(t *testing.T) {
+	r, err := NewRepo("", "", "")
+	assert.Nil(t, err)
+
+	configMap := []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test
+  namespace: hello
+`)
+
+	assert.Nil(t, billyutil.WriteFile(r.fs, "a.yaml", configMap, 0644))
+	assert.Nil(t, billyutil.WriteFile(r.fs, "b.yaml", configMap, 0644))
+
+	obj := util.DefaultObject(util.Kind("ConfigMap", "", "v1"), "test", "hello")
+
+	found, err := r.FindObjectInRepo(obj)
+	assert.Nil(t, found)
+	duplicate, ok := err.(*DuplicateError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a.yaml", "b.yaml"}, duplicate.Paths)
+
+	_, err = r.AddResource(obj, nil, "", "")
+	assert.NotNil(t, err)
+
+	duplicates := r.Duplicates()
+	assert.Equal(t, 1, len(duplicates))
+	assert.Equal(t, ObjectKey{Kind: "ConfigMap", Namespace: "hello", Name: "test"}, duplicates[0].Key)
+
+	assert.Nil(t, r.fs.Remove("b.yaml"))
+	assert.Nil(t, r.reindexFiles("b.yaml"))
+
+	found, err = r.FindObjectInRepo(obj)
+	assert.Nil(t, err)
+	assert.Equal(t, "a.yaml", found.File.Path)
+	assert.Equal(t, 0, len(r.Duplicates()))
+}
+
+func TestFailedWritesLeaveIndexUnchanged(t *testing.T) {
+	r, err := NewRepo("", "", "")
+	assert.Nil(t, err)
+
+	configMap := util.DefaultObject(util.Kind("ConfigMap", "", "v1"), "app", "default").(*unstructured.Unstructured)
+	unstructured.SetNestedField(configMap.Object, "short", "data", "config")
+
+	_, err = r.AddResource(configMap, nil, "", "")
+	assert.Nil(t, err)
+
+	// The new value would be written to a file that already exists.
+	r.SetExternalFiles(&yaml.ExternalFiles{
+		Fields:  []yaml.ExternalField{{Kind: "ConfigMap", Path: "data"}},
+		MinSize: 10,
+	})
+	assert.Nil(t, billyutil.WriteFile(r.fs, "default/ConfigMap/configmap/app/config", []byte("other"), 0644))
+
+	updated := configMap.DeepCopy()
+	unstructured.SetNestedField(updated.Object, "a longer value", "data", "config")
+
+	_, err = r.AddResource(updated, nil, "", "")
+	assert.NotNil(t, err)
+
+	found, err := r.FindObjectInRepo(configMap)
+	assert.Nil(t, err)
+	assert.False(t, found.Changed())
+
+	value, _, _ := unstructured.NestedString(found.Object.(*unstructured.Unstructured).Object, "data", "config")
+	assert.Equal(t, "short", value)
+}
+
+func TestExternalFiles(t *testing.T) {
+	r, err := NewRepo("", "", "")
+	assert.Nil(t, err)
+
+	r.SetExternalFiles(&yaml.ExternalFiles{
+		Fields: []yaml.ExternalField{{Kind: "ConfigMap", Path: "data"}},
+	})
+
+	configMap := util.DefaultObject(util.Kind("ConfigMap", "", "v1"), "dashboards", "monitoring").(*unstructured.Unstructured)
+	unstructured.SetNestedField(configMap.Object, `{"title": "nodes"}`, "data", "nodes.json")
+
+	_, err = r.AddResource(configMap, nil, "", "")
+	assert.Nil(t, err)
+
+	status, err := r.tree.Status()
+	assert.Nil(t, err)
+	assert.True(t, status.IsClean())
+
+	contents, err := util.ReadFile(r.fs, "monitoring/ConfigMap/configmap/dashboards/nodes.json")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"title": "nodes"}`, string(contents))
+
+	// The dashboard is not a manifest, so it is not reported as invalid.
+	objects, err := r.LoadRepoYAMLs()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, 0, len(r.InvalidDocuments()))
+
+	_, err = doCommit("monitoring/ConfigMap/configmap/dashboards/nodes.json", `{"title": "pods"}`, r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.reindexFiles("monitoring/ConfigMap/configmap/dashboards/nodes.json"))
+
+	found, err := r.FindObjectInRepo(configMap)
+	assert.Nil(t, err)
+
+	value, _, _ := unstructured.NestedString(found.Object.(*unstructured.Unstructured).Object, "data", "nodes.json")
+	assert.Equal(t, `{"title": "pods"}`, value)
+	assert.Equal(t, 0, len(r.InvalidDocuments()))
+}
@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"regexp"
+	"strings"
+)
+
+// Matches a full commit SHA.
+var commitRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Matches the space between two comparisons of a range, e.g. ">=1.4.0 <2.0.0".
+var rangeSpaceRegexp = regexp.MustCompile(`([0-9xX*])\s+([<>=!~^])`)
+
+// Selects the revision of a repository that is checked out instead of the head of
+// its branch.
+type Revision struct {
+	// A tag to check out.
+	Tag string
+	// A commit SHA to check out.
+	Commit string
+	// A semantic version range, the newest tag that satisfies it is checked out.
+	Semver string
+	// The parsed semantic version range.
+	constraints *semver.Constraints
+}
+
+// Create a revision from a tag, a commit SHA or a semantic version range, exactly
+// one of which must be set. Comparisons in a range can be separated by spaces or
+// commas, e.g. ">=1.4.0 <2.0.0".
+func NewRevision(tag, commit, semverRange string) (*Revision, error) {
+	set := 0
+	for _, value := range []string{tag, commit, semverRange} {
+		if value != "" {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return nil, errors.New("exactly one of tag, commit or semver must be set")
+	}
+
+	v := &Revision{
+		Tag:    tag,
+		Commit: strings.ToLower(commit),
+		Semver: semverRange,
+	}
+
+	if v.Commit != "" && !commitRegexp.MatchString(v.Commit) {
+		return nil, fmt.Errorf("commit must be a full SHA: %s", commit)
+	}
+
+	if v.Semver != "" {
+		constraints, err := semver.NewConstraint(rangeSpaceRegexp.ReplaceAllString(v.Semver, "$1, $2"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid semver range %s: %s", v.Semver, err)
+		}
+
+		v.constraints = constraints
+	}
+
+	return v, nil
+}
+
+func (v *Revision) String() string {
+	switch {
+	case v.Tag != "":
+		return "tag " + v.Tag
+	case v.Commit != "":
+		return "commit " + v.Commit
+	}
+
+	return "semver " + v.Semver
+}
+
+// Return the reference in refs, as listed from the remote, that the revision
+// selects. Commits are not looked up in refs and have a reference without a name.
+func (v *Revision) resolve(refs []*plumbing.Reference) (*plumbing.Reference, error) {
+	if v.Commit != "" {
+		return plumbing.NewHashReference("", plumbing.NewHash(v.Commit)), nil
+	}
+
+	var newest *semver.Version
+	var selected *plumbing.Reference
+
+	for _, ref := range refs {
+		if !ref.Name().IsTag() {
+			continue
+		}
+
+		name := strings.TrimPrefix(ref.Name().String(), "refs/tags/")
+
+		if v.Tag != "" {
+			if name == v.Tag {
+				return ref, nil
+			}
+
+			continue
+		}
+
+		version, err := semver.NewVersion(name)
+		if err != nil || !v.constraints.Check(version) {
+			continue
+		}
+
+		if newest == nil || version.GreaterThan(newest) {
+			newest = version
+			selected = ref
+		}
+	}
+
+	if selected == nil {
+		return nil, fmt.Errorf("no tag matches %s", v)
+	}
+
+	return selected, nil
+}
@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"fmt"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewRevision(t *testing.T) {
+	_, err := NewRevision("", "", "")
+	assert.NotNil(t, err)
+
+	_, err = NewRevision("v1.0.0", "", ">=1.0.0")
+	assert.NotNil(t, err)
+
+	_, err = NewRevision("", "abc123", "")
+	assert.NotNil(t, err)
+
+	_, err = NewRevision("", "", "not a range")
+	assert.NotNil(t, err)
+
+	revision, err := NewRevision("", "", ">=1.4.0 <2.0.0")
+	assert.Nil(t, err)
+	assert.Equal(t, "semver >=1.4.0 <2.0.0", revision.String())
+}
+
+func TestResolveRevision(t *testing.T) {
+	refs := []*plumbing.Reference{}
+	for i, name := range []string{"refs/heads/v1.9.0", "refs/tags/v1.3.0", "refs/tags/v1.4.0",
+		"refs/tags/1.10.2", "refs/tags/v2.0.0", "refs/tags/latest"} {
+		refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(name),
+			plumbing.NewHash(fmt.Sprintf("%040d", i))))
+	}
+
+	for _, test := range []struct {
+		tag      string
+		semver   string
+		expected string
+	}{
+		{"", ">=1.4.0 <2.0.0", "refs/tags/1.10.2"},
+		{"", ">=1.4.0, <1.5.0", "refs/tags/v1.4.0"},
+		{"", "~1.3", "refs/tags/v1.3.0"},
+		{"", ">=3.0.0", ""},
+		{"latest", "", "refs/tags/latest"},
+		{"v1.9.0", "", ""},
+	} {
+		revision, err := NewRevision(test.tag, "", test.semver)
+		assert.Nil(t, err)
+
+		ref, err := revision.resolve(refs)
+		if test.expected == "" {
+			assert.NotNil(t, err, revision.String())
+		} else {
+			assert.Nil(t, err, revision.String())
+			assert.Equal(t, test.expected, ref.Name().String(), revision.String())
+		}
+	}
+}
+
+func TestPinnedRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitops-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	remote, err := git.Init(store, nil)
+	assert.Nil(t, err)
+
+	deployment := util.Kind("Deployment", "extensions", "v1beta1")
+	hello := util.DefaultObject(deployment, "hello", "default")
+	world := util.DefaultObject(deployment, "world", "default")
+
+	writer, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+
+	_, err = writer.AddResource(hello, nil, "", "")
+	assert.Nil(t, err)
+	head, err := writer.head()
+	assert.Nil(t, err)
+
+	_, err = remote.CreateTag("v1.0.0", head, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "test", Email: "test@test.com", When: time.Now()},
+		Message: "v1.0.0",
+	})
+	assert.Nil(t, err)
+
+	_, err = writer.AddResource(world, nil, "", "")
+	assert.Nil(t, err)
+
+	revision, err := NewRevision("", "", "^1.0.0")
+	assert.Nil(t, err)
+
+	pinned, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+	pinned.SetRevision(revision)
+
+	changed, _, err := pinned.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changed))
+
+	found, err := pinned.FindObjectInRepo(world)
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	found, err = pinned.FindObjectInRepo(hello)
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	// Nothing changes until a newer tag matches.
+	changed, _, err = pinned.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(changed))
+
+	head, err = writer.head()
+	assert.Nil(t, err)
+
+	_, err = remote.CreateTag("v1.1.0", head, nil)
+	assert.Nil(t, err)
+
+	changed, _, err = pinned.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changed))
+
+	found, err = pinned.FindObjectInRepo(world)
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	// A pinned repository cannot be written to.
+	_, err = pinned.AddResource(util.DefaultObject(deployment, "new", "default"), nil, "", "")
+	assert.NotNil(t, err)
+}
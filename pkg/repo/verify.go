@@ -0,0 +1,226 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"hash"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	sshSignatureHeader = "-----BEGIN SSH SIGNATURE-----"
+	sshSignatureFooter = "-----END SSH SIGNATURE-----"
+	// The magic preamble of SSH signatures, see PROTOCOL.sshsig in OpenSSH.
+	sshSignatureMagic = "SSHSIG"
+	// The namespace Git signs commits in.
+	sshSignatureNamespace = "git"
+)
+
+// Returned when the commit that would be checked out is not signed by a trusted key.
+type UnverifiedError struct {
+	// The SHA of the commit.
+	Commit string `json:"commit"`
+	// Why the commit could not be verified.
+	Reason string `json:"reason"`
+}
+
+func (e *UnverifiedError) Error() string {
+	return fmt.Sprintf("commit %s is not signed by a trusted key: %s", e.Commit, e.Reason)
+}
+
+// Verifies that commits are signed by trusted GPG or SSH keys.
+type Verifier struct {
+	keyRing openpgp.EntityList
+	sshKeys []ssh.PublicKey
+}
+
+// Create a verifier trusting the keys in an armored GPG keyring and the SSH public
+// keys in authorized_keys format in sshKeys, either of which may be empty.
+func NewVerifier(keyRing, sshKeys string) (*Verifier, error) {
+	v := &Verifier{}
+
+	if strings.TrimSpace(keyRing) != "" {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keyRing))
+		if err != nil {
+			return nil, fmt.Errorf("could not read GPG keyring: %s", err)
+		}
+
+		v.keyRing = entities
+	}
+
+	rest := []byte(sshKeys)
+	for len(bytes.TrimSpace(rest)) != 0 {
+		key, _, _, remaining, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("could not read SSH keys: %s", err)
+		}
+
+		v.sshKeys = append(v.sshKeys, key)
+		rest = remaining
+	}
+
+	if len(v.keyRing) == 0 && len(v.sshKeys) == 0 {
+		return nil, errors.New("no GPG or SSH keys to verify commits with")
+	}
+
+	return v, nil
+}
+
+// Trust the public key of entity, such as the key the controller signs its commits
+// with.
+func (v *Verifier) Trust(entity *openpgp.Entity) {
+	v.keyRing = append(v.keyRing, entity)
+}
+
+// Read the GPG private key to sign commits with from an armored key, as exported by
+// `gpg --armor --export-secret-keys`. The key must not be protected by a
+// passphrase.
+func ReadSigningKey(armored string) (*openpgp.Entity, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, fmt.Errorf("could not read GPG signing key: %s", err)
+	}
+
+	for _, entity := range entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+
+		if entity.PrivateKey.Encrypted {
+			return nil, errors.New("GPG signing key must not be protected by a passphrase")
+		}
+
+		return entity, nil
+	}
+
+	return nil, errors.New("no GPG private key to sign commits with")
+}
+
+// Return an error if commit is not signed by a trusted key.
+func (v *Verifier) Verify(commit *object.Commit) error {
+	if commit.PGPSignature == "" {
+		return errors.New("commit is not signed")
+	}
+
+	// The signature covers the commit as it is encoded without it.
+	unsigned := *commit
+	unsigned.PGPSignature = ""
+
+	encoded := &plumbing.MemoryObject{}
+	if err := unsigned.Encode(encoded); err != nil {
+		return err
+	}
+
+	reader, err := encoded.Reader()
+	if err != nil {
+		return err
+	}
+
+	payload, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(commit.PGPSignature, sshSignatureHeader) {
+		return v.verifySSH(payload, commit.PGPSignature)
+	}
+
+	if len(v.keyRing) == 0 {
+		return errors.New("commit is signed with GPG but no GPG keys are trusted")
+	}
+
+	_, err = openpgp.CheckArmoredDetachedSignature(v.keyRing, bytes.NewReader(payload),
+		strings.NewReader(commit.PGPSignature))
+	return err
+}
+
+// Verify an armored SSH signature of payload.
+func (v *Verifier) verifySSH(payload []byte, armored string) error {
+	armored = strings.TrimSpace(armored)
+	armored = strings.TrimPrefix(armored, sshSignatureHeader)
+	armored = strings.TrimSuffix(armored, sshSignatureFooter)
+
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(armored), ""))
+	if err != nil {
+		return fmt.Errorf("invalid SSH signature: %s", err)
+	}
+
+	if !bytes.HasPrefix(blob, []byte(sshSignatureMagic)) {
+		return errors.New("invalid SSH signature: missing preamble")
+	}
+
+	sig := struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}{}
+
+	if err := ssh.Unmarshal(blob[len(sshSignatureMagic):], &sig); err != nil {
+		return fmt.Errorf("invalid SSH signature: %s", err)
+	}
+
+	if sig.Version != 1 {
+		return fmt.Errorf("unsupported SSH signature version %d", sig.Version)
+	}
+
+	if sig.Namespace != sshSignatureNamespace {
+		return fmt.Errorf("SSH signature is for namespace %s, not %s", sig.Namespace, sshSignatureNamespace)
+	}
+
+	publicKey, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid SSH signature: %s", err)
+	}
+
+	trusted := false
+	for _, key := range v.sshKeys {
+		if bytes.Equal(key.Marshal(), publicKey.Marshal()) {
+			trusted = true
+		}
+	}
+
+	if !trusted {
+		return fmt.Errorf("SSH key %s is not trusted", ssh.FingerprintSHA256(publicKey))
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported SSH signature hash %s", sig.HashAlgorithm)
+	}
+
+	h.Write(payload)
+
+	signature := &ssh.Signature{}
+	if err := ssh.Unmarshal(sig.Signature, signature); err != nil {
+		return fmt.Errorf("invalid SSH signature: %s", err)
+	}
+
+	return publicKey.Verify(sshSignedData(sig.Namespace, sig.HashAlgorithm, h.Sum(nil)), signature)
+}
+
+// Return the data an SSH signature signs for the hash of a message.
+func sshSignedData(namespace, hashAlgorithm string, digest []byte) []byte {
+	return append([]byte(sshSignatureMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{namespace, "", hashAlgorithm, digest})...)
+}
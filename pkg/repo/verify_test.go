@@ -0,0 +1,269 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return the armored public key of entity.
+func armoredPublicKey(t *testing.T, entity *openpgp.Entity) string {
+	buf := &bytes.Buffer{}
+
+	writer, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, entity.Serialize(writer))
+	assert.Nil(t, writer.Close())
+
+	return buf.String()
+}
+
+// Sign a commit with an SSH key the way git does.
+func sshSign(t *testing.T, signer ssh.Signer, commit *object.Commit) string {
+	encoded := &plumbing.MemoryObject{}
+	assert.Nil(t, commit.Encode(encoded))
+
+	reader, err := encoded.Reader()
+	assert.Nil(t, err)
+
+	payload, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+
+	digest := sha512.Sum512(payload)
+
+	signature, err := signer.Sign(rand.Reader, sshSignedData("git", "sha512", digest[:]))
+	assert.Nil(t, err)
+
+	blob := append([]byte(sshSignatureMagic), ssh.Marshal(struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}{1, signer.PublicKey().Marshal(), "git", "", "sha512", ssh.Marshal(signature)})...)
+
+	return sshSignatureHeader + "\n" + base64.StdEncoding.EncodeToString(blob) + "\n" + sshSignatureFooter + "\n"
+}
+
+func TestVerifySSH(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.Nil(t, err)
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	assert.Nil(t, err)
+
+	verifier, err := NewVerifier("", string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	assert.Nil(t, err)
+
+	signature := object.Signature{Name: "test", Email: "test@test.com", When: time.Now()}
+	commit := &object.Commit{
+		Author:    signature,
+		Committer: signature,
+		Message:   "a commit",
+		TreeHash:  plumbing.NewHash("4b825dc642cb6eb9a060e54bf8d69288fbee4904"),
+	}
+
+	assert.NotNil(t, verifier.Verify(commit))
+
+	commit.PGPSignature = sshSign(t, signer, commit)
+	assert.Nil(t, verifier.Verify(commit))
+
+	commit.PGPSignature = sshSign(t, otherSigner, commit)
+	assert.NotNil(t, verifier.Verify(commit))
+
+	// Changing the commit invalidates the signature.
+	commit.PGPSignature = sshSign(t, signer, commit)
+	commit.Message = "another commit"
+	assert.NotNil(t, verifier.Verify(commit))
+}
+
+func TestUnverifiedCommitsNotCheckedOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitops-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	_, err = git.Init(store, nil)
+	assert.Nil(t, err)
+
+	entity, err := openpgp.NewEntity("test", "", "test@test.com", nil)
+	assert.Nil(t, err)
+
+	verifier, err := NewVerifier(armoredPublicKey(t, entity), "")
+	assert.Nil(t, err)
+
+	deployment := util.Kind("Deployment", "extensions", "v1beta1")
+	hello := util.DefaultObject(deployment, "hello", "default")
+	world := util.DefaultObject(deployment, "world", "default")
+
+	writer, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+
+	commit := func(name string, signKey *openpgp.Entity) {
+		file, err := writer.fs.Create(name + ".yaml")
+		assert.Nil(t, err)
+
+		_, err = file.Write([]byte("apiVersion: extensions/v1beta1\nkind: Deployment\nmetadata:\n  name: " +
+			name + "\n  namespace: default\n"))
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+
+		assert.Nil(t, writer.Add(name+".yaml"))
+
+		_, err = writer.tree.Commit("add "+name, &git.CommitOptions{
+			Author:  &object.Signature{Name: "test", Email: "test@test.com", When: time.Now()},
+			SignKey: signKey,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, writer.Push())
+	}
+
+	commit("hello", entity)
+
+	reader, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+	reader.SetVerifier(verifier)
+
+	// Nothing can be read until a verified commit is checked out.
+	_, err = reader.FindObjectInRepo(hello)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, reader.Pull())
+	assert.Nil(t, reader.Unverified())
+
+	found, err := reader.FindObjectInRepo(hello)
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	// Unsigned commits are not checked out.
+	commit("world", nil)
+
+	err = reader.Pull()
+	assert.NotNil(t, err)
+	assert.NotNil(t, reader.Unverified())
+	assert.True(t, strings.Contains(err.Error(), "not signed"))
+
+	found, err = reader.FindObjectInRepo(world)
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	assert.NotNil(t, reader.Pull())
+
+	// After a restart, the last verified commit is checked out instead.
+	restarted, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+	restarted.SetVerifier(verifier)
+
+	assert.NotNil(t, restarted.Pull())
+	assert.NotNil(t, restarted.Unverified())
+
+	found, err = restarted.FindObjectInRepo(hello)
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+
+	found, err = restarted.FindObjectInRepo(world)
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	// A signed commit on top is checked out.
+	commit("again", entity)
+
+	for _, r := range []*Repo{reader, restarted} {
+		assert.Nil(t, r.Pull())
+		assert.Nil(t, r.Unverified())
+
+		found, err = r.FindObjectInRepo(world)
+		assert.Nil(t, err)
+		assert.NotNil(t, found)
+	}
+}
+
+// Return the armored private key of entity.
+func armoredPrivateKey(t *testing.T, entity *openpgp.Entity) string {
+	buf := &bytes.Buffer{}
+
+	writer, err := armor.Encode(buf, openpgp.PrivateKeyType, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, entity.SerializePrivate(writer, nil))
+	assert.Nil(t, writer.Close())
+
+	return buf.String()
+}
+
+func TestSignedCommitsVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitops-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	_, err = git.Init(store, nil)
+	assert.Nil(t, err)
+
+	entity, err := openpgp.NewEntity("gitops-controller", "", "gitops@example.com", nil)
+	assert.Nil(t, err)
+
+	_, err = ReadSigningKey(armoredPublicKey(t, entity))
+	assert.NotNil(t, err)
+
+	signingKey, err := ReadSigningKey(armoredPrivateKey(t, entity))
+	assert.Nil(t, err)
+
+	// The controller's own commits are signed.
+	writer, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+	writer.SetSigningKey(signingKey)
+
+	hello := util.DefaultObject(util.Kind("Deployment", "extensions", "v1beta1"), "hello", "default")
+	_, err = writer.AddResource(hello, nil, "", "")
+	assert.Nil(t, err)
+
+	// When the controller starts again, its last commit is verified with the
+	// signing key.
+	otherEntity, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	assert.Nil(t, err)
+
+	verifier, err := NewVerifier(armoredPublicKey(t, otherEntity), "")
+	assert.Nil(t, err)
+
+	reader, err := NewRepo(dir, "", "")
+	assert.Nil(t, err)
+	reader.SetVerifier(verifier)
+	assert.NotNil(t, reader.Pull())
+
+	verifier.Trust(signingKey)
+
+	reader, err = NewRepo(dir, "", "")
+	assert.Nil(t, err)
+	reader.SetVerifier(verifier)
+	assert.Nil(t, reader.Pull())
+	assert.Nil(t, reader.Unverified())
+
+	found, err := reader.FindObjectInRepo(hello)
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+}
@@ -0,0 +1,62 @@
+package status
+
+import (
+	"encoding/json"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"net/http"
+	"sync"
+)
+
+// Serves a JSON report of problems that the controller works around rather than
+// stopping for, such as invalid manifests, so that they can be found without
+// searching the logs.
+type Server struct {
+	lock     sync.RWMutex
+	sections map[string]func() interface{}
+}
+
+// Create a new status server with no sections.
+func NewServer() *Server {
+	return &Server{
+		sections: map[string]func() interface{}{},
+	}
+}
+
+// Add a section to the report. fn is called on every request to get the current
+// value of the section.
+func (s *Server) Register(name string, fn func() interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sections[name] = fn
+}
+
+// Return the current report.
+func (s *Server) Report() map[string]interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	report := map[string]interface{}{}
+	for name, fn := range s.sections {
+		report[name] = fn()
+	}
+
+	return report
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(s.Report()); err != nil {
+		util.Log.Error(err, "could not write status")
+	}
+}
+
+// Serve the report at /status on addr.
+func (s *Server) Start(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/status", s)
+
+	util.Log.Info("starting status server", "address", addr)
+	return http.ListenAndServe(addr, mux)
+}
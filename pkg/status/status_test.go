@@ -0,0 +1,27 @@
+package status
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	server := NewServer()
+
+	invalid := []string{}
+	server.Register("invalid", func() interface{} {
+		return invalid
+	})
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"invalid\":[]}\n", recorder.Body.String())
+
+	invalid = append(invalid, "broken.yaml")
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, "{\"invalid\":[\"broken.yaml\"]}\n", recorder.Body.String())
+}
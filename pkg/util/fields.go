@@ -0,0 +1,158 @@
+package util
+
+import (
+	"encoding/json"
+	"github.com/appscode/jsonpatch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"strconv"
+	"strings"
+)
+
+// Split a JSON pointer, e.g. /metadata/labels, into its unescaped segments.
+func SplitPointer(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segment = strings.Replace(segment, "~1", "/", -1)
+		segments[i] = strings.Replace(segment, "~0", "~", -1)
+	}
+
+	return segments
+}
+
+// Return the fields owned by manager according to the managedFields of an object,
+// in the format used by the API server, e.g. {"f:spec": {"f:replicas": {}}}.
+func managedFields(o *unstructured.Unstructured, manager string) []map[string]interface{} {
+	entries, _, _ := unstructured.NestedSlice(o.Object, "metadata", "managedFields")
+
+	owned := []map[string]interface{}{}
+	for _, entry := range entries {
+		fields, ok := entry.(map[string]interface{})
+		if !ok || fields["manager"] != manager {
+			continue
+		}
+
+		// Before Kubernetes 1.18 the fields were stored in fields instead of fieldsV1.
+		for _, key := range []string{"fieldsV1", "fields"} {
+			if set, ok := fields[key].(map[string]interface{}); ok {
+				owned = append(owned, set)
+			}
+		}
+	}
+
+	return owned
+}
+
+// Return the key of a list item in a managed fields set, or nil if it is not in it.
+// Items are keyed by the values of their key fields (k:), by their value (v:) or by
+// their index (i:).
+func managedListItem(set map[string]interface{}, item interface{}, index int) interface{} {
+	encodedItem, _ := json.Marshal(item)
+
+	for key, value := range set {
+		switch {
+		case strings.HasPrefix(key, "k:"):
+			fields := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &fields); err != nil {
+				continue
+			}
+
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			matches := true
+			for name, expected := range fields {
+				encodedExpected, _ := json.Marshal(expected)
+				encodedActual, _ := json.Marshal(itemMap[name])
+				if string(encodedExpected) != string(encodedActual) {
+					matches = false
+				}
+			}
+
+			if matches {
+				return value
+			}
+		case strings.HasPrefix(key, "v:"):
+			if strings.TrimPrefix(key, "v:") == string(encodedItem) {
+				return value
+			}
+		case key == "i:"+strconv.Itoa(index):
+			return value
+		}
+	}
+
+	return nil
+}
+
+// Return true if manager owns the field at the JSON pointer path in an object, or
+// any field below it, according to the object's managedFields.
+func ManagesField(o runtime.Object, manager, path string) bool {
+	asUnstructured, ok := o.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+
+	for _, set := range managedFields(asUnstructured, manager) {
+		var value interface{} = asUnstructured.Object
+		var node interface{} = set
+
+		for _, segment := range SplitPointer(path) {
+			fields, ok := node.(map[string]interface{})
+			if !ok {
+				node = nil
+				break
+			}
+
+			switch typed := value.(type) {
+			case map[string]interface{}:
+				node = fields["f:"+segment]
+				value = typed[segment]
+			case []interface{}:
+				index, err := strconv.Atoi(segment)
+				if err != nil || index < 0 || index >= len(typed) {
+					node = nil
+					break
+				}
+
+				node = managedListItem(fields, typed[index], index)
+				value = typed[index]
+			default:
+				node = nil
+			}
+
+			if node == nil {
+				break
+			}
+		}
+
+		if node != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the patches from live to the desired state that change fields manager is
+// responsible for: every addition or change, and removals of fields manager owns.
+// Fields that are only set in live are owned by the API server or other managers.
+func ManagedPatches(live runtime.Object, patches []jsonpatch.Operation, manager string) []jsonpatch.Operation {
+	managed := []jsonpatch.Operation{}
+
+	for _, patch := range patches {
+		if patch.Operation == "remove" && !ManagesField(live, manager, patch.Path) {
+			continue
+		}
+
+		managed = append(managed, patch)
+	}
+
+	return managed
+}
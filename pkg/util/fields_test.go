@@ -0,0 +1,91 @@
+package util
+
+import (
+	"github.com/appscode/jsonpatch"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"testing"
+)
+
+func TestSplitPointer(t *testing.T) {
+	assert.Equal(t, []string{}, SplitPointer("/"))
+	assert.Equal(t, []string{"metadata", "labels"}, SplitPointer("/metadata/labels"))
+	assert.Equal(t, []string{"metadata", "annotations", "example.com/a~b"},
+		SplitPointer("/metadata/annotations/example.com~1a~0b"))
+}
+
+func TestManagesField(t *testing.T) {
+	dep := DefaultObject(Kind("Deployment", "apps", "v1"), "name", "default").(*unstructured.Unstructured)
+
+	unstructured.SetNestedField(dep.Object, int64(3), "spec", "replicas")
+	unstructured.SetNestedSlice(dep.Object, []interface{}{
+		map[string]interface{}{
+			"name":            "nginx",
+			"image":           "nginx",
+			"imagePullPolicy": "Always",
+		},
+	}, "spec", "template", "spec", "containers")
+	unstructured.SetNestedStringSlice(dep.Object, []string{"a", "b"}, "spec", "template", "spec", "args")
+	unstructured.SetNestedSlice(dep.Object, []interface{}{
+		map[string]interface{}{
+			"manager": "gitops-controller",
+			"fieldsV1": map[string]interface{}{
+				"f:spec": map[string]interface{}{
+					"f:template": map[string]interface{}{
+						"f:spec": map[string]interface{}{
+							"f:containers": map[string]interface{}{
+								`k:{"name":"nginx"}`: map[string]interface{}{
+									".":       map[string]interface{}{},
+									"f:image": map[string]interface{}{},
+								},
+							},
+							"f:args": map[string]interface{}{
+								`v:"b"`: map[string]interface{}{},
+							},
+						},
+					},
+				},
+			},
+		},
+		map[string]interface{}{
+			"manager": "kubectl",
+			"fields": map[string]interface{}{
+				"f:spec": map[string]interface{}{
+					"f:replicas": map[string]interface{}{},
+				},
+			},
+		},
+	}, "metadata", "managedFields")
+
+	for _, test := range []struct {
+		manager  string
+		path     string
+		expected bool
+	}{
+		{"gitops-controller", "/spec/template/spec/containers/0/image", true},
+		{"gitops-controller", "/spec/template/spec/containers/0", true},
+		{"gitops-controller", "/spec/template", true},
+		{"gitops-controller", "/spec/template/spec/containers/0/imagePullPolicy", false},
+		{"gitops-controller", "/spec/template/spec/containers/1", false},
+		{"gitops-controller", "/spec/template/spec/args/1", true},
+		{"gitops-controller", "/spec/template/spec/args/0", false},
+		{"gitops-controller", "/spec/replicas", false},
+		{"gitops-controller", "/status", false},
+		{"kubectl", "/spec/replicas", true},
+		{"kubectl", "/spec/template/spec/containers/0/image", false},
+	} {
+		assert.Equal(t, test.expected, ManagesField(dep, test.manager, test.path), test.manager+" "+test.path)
+	}
+
+	patches := ManagedPatches(dep, []jsonpatch.Operation{
+		{Operation: "remove", Path: "/spec/template/spec/containers/0/image"},
+		{Operation: "remove", Path: "/spec/template/spec/containers/0/imagePullPolicy"},
+		{Operation: "replace", Path: "/spec/replicas", Value: 1},
+		{Operation: "remove", Path: "/status"},
+	}, "gitops-controller")
+
+	assert.Equal(t, []jsonpatch.Operation{
+		{Operation: "remove", Path: "/spec/template/spec/containers/0/image"},
+		{Operation: "replace", Path: "/spec/replicas", Value: 1},
+	}, patches)
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"gopkg.in/src-d/go-billy.v4"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Read the contents of a file.
+func ReadFile(fs billy.Filesystem, path string) ([]byte, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+// Call cb for path and every file and directory underneath it. Does nothing if path
+// does not exist.
+func WalkAll(fs billy.Filesystem, path string, cb func(string, os.FileInfo) error) error {
+	info, err := fs.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := cb(path, info); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	files, err := fs.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := WalkAll(fs, filepath.Join(path, file.Name()), cb); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package util
+
+import (
+	"encoding/json"
+	"github.com/appscode/jsonpatch"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"reflect"
+	"strconv"
+)
+
+// The path of a resource quantity in objects of a kind. An empty kind matches
+// objects of every kind and "*" matches any segment of a path.
+type quantityPath struct {
+	kind string
+	path []string
+}
+
+var (
+	// Paths whose values are resource quantities. Only these are compared as
+	// quantities, since a string elsewhere may parse as a quantity without being
+	// one. Durations are not normalized: the API server stores no built-in field as
+	// a metav1.Duration, and custom resources are stored as they were written.
+	quantityPaths = []quantityPath{
+		{path: []string{"resources", "limits", "*"}},
+		{path: []string{"resources", "requests", "*"}},
+		{path: []string{"emptyDir", "sizeLimit"}},
+		{kind: "ResourceQuota", path: []string{"spec", "hard", "*"}},
+		{kind: "ResourceQuota", path: []string{"status", "hard", "*"}},
+		{kind: "ResourceQuota", path: []string{"status", "used", "*"}},
+		{kind: "LimitRange", path: []string{"spec", "limits", "*", "max", "*"}},
+		{kind: "LimitRange", path: []string{"spec", "limits", "*", "min", "*"}},
+		{kind: "LimitRange", path: []string{"spec", "limits", "*", "default", "*"}},
+		{kind: "LimitRange", path: []string{"spec", "limits", "*", "defaultRequest", "*"}},
+		{kind: "LimitRange", path: []string{"spec", "limits", "*", "maxLimitRequestRatio", "*"}},
+		{kind: "PersistentVolumeClaim", path: []string{"status", "capacity", "*"}},
+		{kind: "PersistentVolume", path: []string{"spec", "capacity", "*"}},
+		{kind: "Node", path: []string{"status", "capacity", "*"}},
+		{kind: "Node", path: []string{"status", "allocatable", "*"}},
+	}
+
+	// Fields that are either an integer or a string.
+	intOrStringFields = map[string]bool{
+		"targetPort":     true,
+		"maxSurge":       true,
+		"maxUnavailable": true,
+		"minAvailable":   true,
+	}
+
+	// Fields whose port field is an integer or a string.
+	intOrStringPorts = map[string]bool{
+		"httpGet":   true,
+		"tcpSocket": true,
+	}
+)
+
+// Return a number as a float64, or false if it is not a number.
+func toFloat(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case float32:
+		return float64(number), true
+	case float64:
+		return number, true
+	case json.Number:
+		parsed, err := number.Float64()
+		return parsed, err == nil
+	}
+
+	return 0, false
+}
+
+// Return a string or number as a string.
+func toString(value interface{}) (string, bool) {
+	if str, ok := value.(string); ok {
+		return str, true
+	}
+
+	if number, ok := toFloat(value); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64), true
+	}
+
+	return "", false
+}
+
+// Return true if path is a resource quantity in objects of kind. Paths of
+// quantities without a kind may be at any depth, such as in pod templates.
+func isQuantity(kind string, path []string) bool {
+	for _, quantity := range quantityPaths {
+		if quantity.kind != "" && quantity.kind != kind {
+			continue
+		}
+
+		offset := len(path) - len(quantity.path)
+		if offset < 0 || (quantity.kind != "" && offset != 0) {
+			continue
+		}
+
+		matches := true
+		for i, segment := range quantity.path {
+			if segment != "*" && segment != path[offset+i] {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return a string or number as a resource quantity.
+func toQuantity(value interface{}) (resource.Quantity, bool) {
+	str, ok := toString(value)
+	if !ok {
+		return resource.Quantity{}, false
+	}
+
+	quantity, err := resource.ParseQuantity(str)
+	return quantity, err == nil
+}
+
+// Return true if a and b, the values at path in an object of kind, are equal when
+// compared the way the API server compares them: numbers are equal regardless of
+// their type, resource quantities are equal if they are the same amount (e.g., 1000m
+// and 1) and int-or-string fields are equal if they have the same string
+// representation.
+func SemanticallyEqual(kind string, path []string, a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+
+	switch typedA := a.(type) {
+	case map[string]interface{}:
+		typedB, ok := b.(map[string]interface{})
+		if !ok || len(typedA) != len(typedB) {
+			return false
+		}
+
+		for key, value := range typedA {
+			other, ok := typedB[key]
+			if !ok || !SemanticallyEqual(kind, append(path[:len(path):len(path)], key), value, other) {
+				return false
+			}
+		}
+
+		return true
+	case []interface{}:
+		typedB, ok := b.([]interface{})
+		if !ok || len(typedA) != len(typedB) {
+			return false
+		}
+
+		for i := range typedA {
+			if !SemanticallyEqual(kind, append(path[:len(path):len(path)], strconv.Itoa(i)), typedA[i], typedB[i]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	numberA, okA := toFloat(a)
+	numberB, okB := toFloat(b)
+	if okA && okB {
+		return numberA == numberB
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	field := path[len(path)-1]
+	parent := ""
+	if len(path) > 1 {
+		parent = path[len(path)-2]
+	}
+
+	if isQuantity(kind, path) {
+		quantityA, okA := toQuantity(a)
+		quantityB, okB := toQuantity(b)
+		if okA && okB {
+			return quantityA.Cmp(quantityB) == 0
+		}
+	}
+
+	if intOrStringFields[field] || (field == "port" && intOrStringPorts[parent]) {
+		strA, okA := toString(a)
+		strB, okB := toString(b)
+		return okA && okB && strA == strB
+	}
+
+	return false
+}
+
+// Return the value at path in an object, or false if there is none.
+func valueAtPath(obj interface{}, path []string) (interface{}, bool) {
+	for _, segment := range path {
+		switch typed := obj.(type) {
+		case map[string]interface{}:
+			value, ok := typed[segment]
+			if !ok {
+				return nil, false
+			}
+
+			obj = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(typed) {
+				return nil, false
+			}
+
+			obj = typed[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return obj, true
+}
+
+// Return the patches to original that change a value to one that is not
+// semantically equal to it, see SemanticallyEqual.
+func SemanticPatches(original runtime.Object, patches []jsonpatch.Operation) ([]jsonpatch.Operation, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(original)
+	if err != nil {
+		return nil, err
+	}
+
+	kind := GetType(original).Kind
+
+	changed := []jsonpatch.Operation{}
+
+	for _, patch := range patches {
+		if patch.Operation == "replace" {
+			path := SplitPointer(patch.Path)
+
+			value, ok := valueAtPath(content, path)
+			if ok && SemanticallyEqual(kind, path, value, patch.Value) {
+				continue
+			}
+		}
+
+		changed = append(changed, patch)
+	}
+
+	return changed, nil
+}
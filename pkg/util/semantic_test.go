@@ -0,0 +1,92 @@
+package util
+
+import (
+	"encoding/json"
+	"github.com/appscode/jsonpatch"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"testing"
+)
+
+func TestSemanticallyEqual(t *testing.T) {
+	for _, test := range []struct {
+		kind     string
+		path     string
+		a        interface{}
+		b        interface{}
+		expected bool
+	}{
+		{"Pod", "/spec/replicas", int64(1), float64(1), true},
+		{"Pod", "/spec/replicas", int64(1), json.Number("1"), true},
+		{"Pod", "/spec/replicas", int64(1), float64(2), false},
+		{"Pod", "/spec/containers/0/resources/limits/cpu", "1000m", "1", true},
+		{"Pod", "/spec/containers/0/resources/limits/cpu", "500m", "1", false},
+		{"Pod", "/spec/containers/0/resources/requests/memory", "1Gi", float64(1073741824), true},
+		{"Pod", "/spec/containers/0/resources/requests/memory", "1Gi", "1G", false},
+		{"Pod", "/spec/volumes/0/emptyDir/sizeLimit", "1Gi", "1024Mi", true},
+		{"ResourceQuota", "/spec/hard/pods", "10", int64(10), true},
+		{"Pod", "/spec/containers/0/env/0/value", "1.0", "1", false},
+		{"Pod", "/spec/containers/0/image", "1000m", "1", false},
+		{"ResourceQuota", "/status/used/pods", "10", int64(10), true},
+		{"LimitRange", "/spec/limits/0/defaultRequest/cpu", "0.5", "500m", true},
+		{"PersistentVolumeClaim", "/spec/resources/requests/storage", "1Gi", "1024Mi", true},
+		{"PersistentVolumeClaim", "/status/capacity/storage", "1Gi", "1024Mi", true},
+		{"Node", "/status/allocatable/cpu", "2", "2000m", true},
+		{"ConfigMap", "/data/limits/cpu", "1", "1000m", false},
+		{"Deployment", "/spec/hard/pods", "10", "1e1", false},
+		{"ResourceQuota", "/spec/template/spec/hard/pods", "10", "1e1", false},
+		{"Widget", "/spec/capacity/used", "1", "1000m", false},
+		{"Widget", "/spec/ttl", "1m", "60s", false},
+		{"Pod", "/spec/ports/0/targetPort", "8080", int64(8080), true},
+		{"Pod", "/spec/ports/0/targetPort", "http", int64(8080), false},
+		{"Pod", "/spec/strategy/rollingUpdate/maxSurge", "25%", "25%", true},
+		{"Pod", "/spec/containers/0/livenessProbe/httpGet/port", float64(80), "80", true},
+		{"Pod", "/spec/ports/0/port", float64(80), "80", false},
+		{"Pod", "/spec/containers/0/resources", map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "1", "memory": "1Gi"},
+		}, map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "1000m", "memory": "1024Mi"},
+		}, true},
+		{"Pod", "/spec/containers/0/resources", map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "1"},
+		}, map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "1", "memory": "1Gi"},
+		}, false},
+		{"Pod", "/spec/containers", []interface{}{
+			map[string]interface{}{"resources": map[string]interface{}{"requests": map[string]interface{}{"cpu": "0.5"}}},
+		}, []interface{}{
+			map[string]interface{}{"resources": map[string]interface{}{"requests": map[string]interface{}{"cpu": "500m"}}},
+		}, true},
+	} {
+		assert.Equal(t, test.expected, SemanticallyEqual(test.kind, SplitPointer(test.path), test.a, test.b), test.path)
+	}
+}
+
+func TestSemanticPatches(t *testing.T) {
+	dep := DefaultObject(Kind("Deployment", "apps", "v1"), "name", "default").(*unstructured.Unstructured)
+	unstructured.SetNestedField(dep.Object, int64(3), "spec", "replicas")
+	unstructured.SetNestedSlice(dep.Object, []interface{}{
+		map[string]interface{}{
+			"name": "nginx",
+			"resources": map[string]interface{}{
+				"limits": map[string]interface{}{
+					"cpu":    "1",
+					"memory": "1073741824",
+				},
+			},
+		},
+	}, "spec", "template", "spec", "containers")
+
+	patches, err := SemanticPatches(dep, []jsonpatch.Operation{
+		{Operation: "replace", Path: "/spec/replicas", Value: float64(3)},
+		{Operation: "replace", Path: "/spec/template/spec/containers/0/resources/limits/cpu", Value: "1000m"},
+		{Operation: "replace", Path: "/spec/template/spec/containers/0/resources/limits/memory", Value: "1Gi"},
+		{Operation: "replace", Path: "/spec/template/spec/containers/0/name", Value: "httpd"},
+		{Operation: "add", Path: "/spec/paused", Value: true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []jsonpatch.Operation{
+		{Operation: "replace", Path: "/spec/template/spec/containers/0/name", Value: "httpd"},
+		{Operation: "add", Path: "/spec/paused", Value: true},
+	}, patches)
+}
@@ -14,12 +14,25 @@ import (
 	"path/filepath"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 	"strings"
+	"text/template"
 )
 
 var (
 	Scheme    = runtime.NewScheme()
 	defaulter = runtime.ObjectDefaulter(Scheme)
 	Log       = logf.Log.WithName("gitops-controller")
+
+	// Functions available to the templates in the configuration.
+	TemplateFuncs = template.FuncMap{
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"default": func(def string, value string) string {
+			if value == "" {
+				return def
+			}
+			return value
+		},
+	}
 )
 
 func init() {
@@ -58,9 +71,9 @@ func DefaultObject(kind runtime.Object, name, namespace string) runtime.Object {
 	return obj
 }
 
-func MarshalObject(o runtime.Object, w io.Writer) error {
-	encoder := json.NewYAMLSerializer(json.DefaultMetaFactory, nil, nil)
-
+// Return a copy of the object with server-populated metadata, noisy annotations and
+// the status field removed.
+func StripObject(o runtime.Object) runtime.Object {
 	copied := o.DeepCopyObject()
 
 	meta := GetMeta(copied)
@@ -80,9 +93,48 @@ func MarshalObject(o runtime.Object, w io.Writer) error {
 	asUnstructured, ok := copied.(*unstructured.Unstructured)
 	if ok {
 		delete(asUnstructured.Object, "status")
+		unstructured.RemoveNestedField(asUnstructured.Object, "metadata", "managedFields")
+	}
+
+	return copied
+}
+
+func MarshalObject(o runtime.Object, w io.Writer) error {
+	encoder := json.NewYAMLSerializer(json.DefaultMetaFactory, nil, nil)
+	return encoder.Encode(StripObject(o), w)
+}
+
+// Return the name of the field manager that most recently modified the object,
+// according to its managedFields. Returns an empty string if the object has no
+// managedFields.
+func LastManager(o runtime.Object) string {
+	asUnstructured, ok := o.(*unstructured.Unstructured)
+	if !ok {
+		return ""
+	}
+
+	managedFields, _, _ := unstructured.NestedSlice(asUnstructured.Object, "metadata", "managedFields")
+
+	manager := ""
+	lastTime := ""
+
+	for _, field := range managedFields {
+		entry, ok := field.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		name, _ := entry["manager"].(string)
+		time, _ := entry["time"].(string)
+
+		// RFC3339 timestamps sort lexically.
+		if name != "" && time >= lastTime {
+			manager = name
+			lastTime = time
+		}
 	}
 
-	return encoder.Encode(copied, w)
+	return manager
 }
 
 func PatchMatchesPath(patch jsonpatch.Operation, path string) (bool, error) {
@@ -12,6 +12,9 @@ func TestMarshalObject(t *testing.T) {
 	dep := DefaultObject(Kind("Deployment", "extensions", "v1beta1"), "name", "default")
 	asUnstructured := dep.(*unstructured.Unstructured)
 	asUnstructured.Object["status"] = map[string]interface{}{"status": "ok"}
+	unstructured.SetNestedSlice(asUnstructured.Object, []interface{}{
+		map[string]interface{}{"manager": "kubectl"},
+	}, "metadata", "managedFields")
 
 	meta := GetMeta(asUnstructured)
 	meta.SetAnnotations(map[string]string{
@@ -31,7 +34,31 @@ func TestMarshalObject(t *testing.T) {
 	kind := GetType(obj)
 	assert.Equal(t, map[string]string{"my": "annotation"}, meta.GetAnnotations())
 	assert.Equal(t, nil, obj.Object["status"])
+	assert.Equal(t, "", LastManager(obj))
 	assert.Equal(t, "name", meta.GetName())
 	assert.Equal(t, "default", meta.GetNamespace())
 	assert.Equal(t, "Deployment", kind.Kind)
 }
+
+func TestLastManager(t *testing.T) {
+	dep := DefaultObject(Kind("Deployment", "extensions", "v1beta1"), "name", "default")
+	assert.Equal(t, "", LastManager(dep))
+
+	asUnstructured := dep.(*unstructured.Unstructured)
+	unstructured.SetNestedSlice(asUnstructured.Object, []interface{}{
+		map[string]interface{}{
+			"manager": "kubectl",
+			"time":    "2019-03-01T10:00:00Z",
+		},
+		map[string]interface{}{
+			"manager": "kube-controller-manager",
+			"time":    "2019-03-01T12:00:00Z",
+		},
+		map[string]interface{}{
+			"manager": "helm",
+			"time":    "2019-03-01T11:00:00Z",
+		},
+	}, "metadata", "managedFields")
+
+	assert.Equal(t, "kube-controller-manager", LastManager(dep))
+}
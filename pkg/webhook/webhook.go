@@ -0,0 +1,333 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The largest request body that is accepted, push events with many commits can be
+// large but are never this large.
+const maxBodySize = 25 * 1024 * 1024
+
+// A push to a repository, as sent by any of the supported services.
+type push struct {
+	// The URLs the repository can be reached at.
+	URLs []string
+	// The references that were pushed to, e.g. refs/heads/master.
+	Refs []string
+}
+
+// Receives push webhooks from GitHub, GitLab, Gitea and Bitbucket and calls Trigger
+// when the repository and branch the controller is watching are pushed to.
+type Receiver struct {
+	// The URL of the watched repository.
+	URL string
+	// The watched branch.
+	Branch string
+	// If true, pushes of any tag to the watched repository also call Trigger.
+	Tags bool
+	// The secret webhooks are signed with, or the token GitLab sends.
+	Secret string
+	// Called for every verified push to the watched repository and branch.
+	Trigger func()
+}
+
+// Normalize a repository URL so that the HTTP and SSH URLs of a repository are
+// equal, e.g. git@github.com:org/repo.git and https://github.com/org/repo both
+// become github.com/org/repo.
+func normalizeURL(repoURL string) string {
+	repoURL = strings.TrimSpace(repoURL)
+
+	if parsed, err := url.Parse(repoURL); err == nil && parsed.Host != "" {
+		repoURL = parsed.Hostname() + parsed.Path
+	} else if i := strings.Index(repoURL, ":"); i != -1 {
+		// scp-like syntax, user@host:path.
+		host := repoURL[:i]
+		if at := strings.LastIndex(host, "@"); at != -1 {
+			host = host[at+1:]
+		}
+
+		repoURL = host + "/" + strings.TrimPrefix(repoURL[i+1:], "/")
+	}
+
+	repoURL = strings.TrimSuffix(strings.TrimSuffix(repoURL, "/"), ".git")
+	return strings.ToLower(repoURL)
+}
+
+// Return true if body was signed with the secret. signature is the hex encoded
+// HMAC, optionally prefixed with the name of the hash, e.g. sha256=.
+func (r *Receiver) verifySignature(body []byte, signature string) bool {
+	newHash := sha256.New
+
+	if strings.HasPrefix(signature, "sha1=") {
+		newHash = func() hash.Hash { return sha1.New() }
+		signature = strings.TrimPrefix(signature, "sha1=")
+	} else {
+		signature = strings.TrimPrefix(signature, "sha256=")
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(newHash, []byte(r.Secret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// Return true if token is the secret.
+func (r *Receiver) verifyToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(r.Secret)) == 1
+}
+
+// Decode the push event in a request, verifying that it was sent with the secret.
+// Returns nil if the request is a verified event but not a push.
+func (r *Receiver) decode(req *http.Request, body []byte) (*push, error) {
+	switch {
+	case req.Header.Get("X-GitHub-Event") != "":
+		signature := req.Header.Get("X-Hub-Signature-256")
+		if signature == "" {
+			signature = req.Header.Get("X-Hub-Signature")
+		}
+
+		if !r.verifySignature(body, signature) {
+			return nil, fmt.Errorf("invalid GitHub signature")
+		}
+
+		if req.Header.Get("X-GitHub-Event") != "push" {
+			return nil, nil
+		}
+
+		return decodeGitHub(body)
+	case req.Header.Get("X-Gitea-Event") != "":
+		if !r.verifySignature(body, req.Header.Get("X-Gitea-Signature")) {
+			return nil, fmt.Errorf("invalid Gitea signature")
+		}
+
+		if req.Header.Get("X-Gitea-Event") != "push" {
+			return nil, nil
+		}
+
+		return decodeGitHub(body)
+	case req.Header.Get("X-Gitlab-Event") != "":
+		if !r.verifyToken(req.Header.Get("X-Gitlab-Token")) {
+			return nil, fmt.Errorf("invalid GitLab token")
+		}
+
+		if req.Header.Get("X-Gitlab-Event") != "Push Hook" {
+			return nil, nil
+		}
+
+		return decodeGitLab(body)
+	case req.Header.Get("X-Event-Key") != "":
+		if !r.verifySignature(body, req.Header.Get("X-Hub-Signature")) {
+			return nil, fmt.Errorf("invalid Bitbucket signature")
+		}
+
+		switch req.Header.Get("X-Event-Key") {
+		case "repo:push":
+			return decodeBitbucketCloud(body)
+		case "repo:refs_changed":
+			return decodeBitbucketServer(body)
+		}
+
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("request is not a GitHub, GitLab, Gitea or Bitbucket webhook")
+}
+
+// Decode a GitHub or Gitea push event.
+func decodeGitHub(body []byte) (*push, error) {
+	event := struct {
+		Ref        string `json:"ref"`
+		Repository struct {
+			CloneURL string `json:"clone_url"`
+			SSHURL   string `json:"ssh_url"`
+			HTMLURL  string `json:"html_url"`
+		} `json:"repository"`
+	}{}
+
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	return &push{
+		URLs: []string{event.Repository.CloneURL, event.Repository.SSHURL, event.Repository.HTMLURL},
+		Refs: []string{event.Ref},
+	}, nil
+}
+
+// Decode a GitLab push event.
+func decodeGitLab(body []byte) (*push, error) {
+	event := struct {
+		Ref     string `json:"ref"`
+		Project struct {
+			GitSSHURL  string `json:"git_ssh_url"`
+			GitHTTPURL string `json:"git_http_url"`
+			WebURL     string `json:"web_url"`
+		} `json:"project"`
+	}{}
+
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	return &push{
+		URLs: []string{event.Project.GitSSHURL, event.Project.GitHTTPURL, event.Project.WebURL},
+		Refs: []string{event.Ref},
+	}, nil
+}
+
+// Decode a Bitbucket Cloud push event.
+func decodeBitbucketCloud(body []byte) (*push, error) {
+	event := struct {
+		Push struct {
+			Changes []struct {
+				New *struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				} `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+		Repository struct {
+			Links struct {
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+			} `json:"links"`
+		} `json:"repository"`
+	}{}
+
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	p := &push{
+		URLs: []string{event.Repository.Links.HTML.Href},
+	}
+
+	// Deleted branches and tags have no new state.
+	for _, change := range event.Push.Changes {
+		if change.New == nil {
+			continue
+		}
+
+		switch change.New.Type {
+		case "branch":
+			p.Refs = append(p.Refs, "refs/heads/"+change.New.Name)
+		case "tag":
+			p.Refs = append(p.Refs, "refs/tags/"+change.New.Name)
+		}
+	}
+
+	return p, nil
+}
+
+// Decode a Bitbucket Server push event.
+func decodeBitbucketServer(body []byte) (*push, error) {
+	event := struct {
+		Changes []struct {
+			RefID string `json:"refId"`
+		} `json:"changes"`
+		Repository struct {
+			Links struct {
+				Clone []struct {
+					Href string `json:"href"`
+				} `json:"clone"`
+			} `json:"links"`
+		} `json:"repository"`
+	}{}
+
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	p := &push{}
+
+	for _, link := range event.Repository.Links.Clone {
+		p.URLs = append(p.URLs, link.Href)
+	}
+
+	for _, change := range event.Changes {
+		p.Refs = append(p.Refs, change.RefID)
+	}
+
+	return p, nil
+}
+
+// Return true if the push is to the watched repository and branch, or to a tag if
+// tags are watched.
+func (r *Receiver) matches(p *push) bool {
+	watched := normalizeURL(r.URL)
+
+	matchesURL := false
+	for _, pushURL := range p.URLs {
+		if pushURL != "" && normalizeURL(pushURL) == watched {
+			matchesURL = true
+		}
+	}
+
+	if !matchesURL {
+		return false
+	}
+
+	for _, ref := range p.Refs {
+		if ref == "refs/heads/"+r.Branch || (r.Tags && strings.HasPrefix(ref, "refs/tags/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := r.decode(req, body)
+	if err != nil {
+		util.Log.Info("rejecting webhook", "error", err.Error(), "remote", req.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if p == nil || !r.matches(p) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	util.Log.Info("received push", "url", r.URL, "branch", r.Branch)
+	r.Trigger()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Receive webhooks at /webhook on addr.
+func (r *Receiver) Start(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", r)
+
+	util.Log.Info("starting webhook receiver", "address", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestNormalizeURL(t *testing.T) {
+	for _, repoURL := range []string{
+		"git@github.com:justinbarrick/manifests.git",
+		"ssh://git@github.com/justinbarrick/manifests.git",
+		"https://github.com/justinbarrick/manifests",
+		"https://user@GitHub.com/justinbarrick/manifests.git/",
+	} {
+		assert.Equal(t, "github.com/justinbarrick/manifests", normalizeURL(repoURL), repoURL)
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	triggered := 0
+
+	receiver := &Receiver{
+		URL:     "git@github.com:justinbarrick/manifests.git",
+		Branch:  "master",
+		Secret:  "hello",
+		Trigger: func() { triggered++ },
+	}
+
+	github := `{"ref": "refs/heads/master", "repository": {"clone_url": "https://github.com/justinbarrick/manifests.git", "ssh_url": "git@github.com:justinbarrick/manifests.git"}}`
+	otherBranch := `{"ref": "refs/heads/develop", "repository": {"clone_url": "https://github.com/justinbarrick/manifests.git"}}`
+	otherRepo := `{"ref": "refs/heads/master", "repository": {"clone_url": "https://github.com/justinbarrick/other.git"}}`
+	gitlab := `{"ref": "refs/heads/master", "project": {"git_ssh_url": "git@github.com:justinbarrick/manifests.git"}}`
+	bitbucketCloud := `{"push": {"changes": [{"new": {"type": "branch", "name": "master"}}]}, "repository": {"links": {"html": {"href": "https://github.com/justinbarrick/manifests"}}}}`
+	bitbucketServer := `{"changes": [{"refId": "refs/heads/master"}], "repository": {"links": {"clone": [{"href": "ssh://git@github.com/justinbarrick/manifests.git"}]}}}`
+	tag := `{"ref": "refs/tags/v1.0.0", "repository": {"clone_url": "https://github.com/justinbarrick/manifests.git"}}`
+
+	for _, test := range []struct {
+		name      string
+		body      string
+		headers   map[string]string
+		status    int
+		triggered bool
+	}{
+		{"github", github, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("hello", github)}, http.StatusAccepted, true},
+		{"github bad signature", github, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("bad", github)}, http.StatusUnauthorized, false},
+		{"github no signature", github, map[string]string{"X-GitHub-Event": "push"}, http.StatusUnauthorized, false},
+		{"github ping", "{}", map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + sign("hello", "{}")}, http.StatusNoContent, false},
+		{"github other branch", otherBranch, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("hello", otherBranch)}, http.StatusNoContent, false},
+		{"github other repository", otherRepo, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("hello", otherRepo)}, http.StatusNoContent, false},
+		{"gitea", github, map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": sign("hello", github)}, http.StatusAccepted, true},
+		{"gitlab", gitlab, map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "hello"}, http.StatusAccepted, true},
+		{"gitlab bad token", gitlab, map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "bad"}, http.StatusUnauthorized, false},
+		{"bitbucket cloud", bitbucketCloud, map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": "sha256=" + sign("hello", bitbucketCloud)}, http.StatusAccepted, true},
+		{"bitbucket server", bitbucketServer, map[string]string{"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": "sha256=" + sign("hello", bitbucketServer)}, http.StatusAccepted, true},
+		{"unknown", github, map[string]string{}, http.StatusUnauthorized, false},
+		{"tag", tag, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("hello", tag)}, http.StatusNoContent, false},
+	} {
+		triggered = 0
+
+		req := httptest.NewRequest("POST", "/webhook", strings.NewReader(test.body))
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+
+		w := httptest.NewRecorder()
+		receiver.ServeHTTP(w, req)
+
+		assert.Equal(t, test.status, w.Code, test.name)
+		assert.Equal(t, test.triggered, triggered == 1, test.name)
+	}
+
+	// Tags trigger a sync if they are watched.
+	receiver.Tags = true
+	triggered = 0
+
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(tag))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", "sha256="+sign("hello", tag))
+
+	w := httptest.NewRecorder()
+	receiver.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, 1, triggered)
+}
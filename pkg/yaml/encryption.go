@@ -0,0 +1,358 @@
+package yaml
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// Matches values encrypted with age, ENC[AGE,<base64 ciphertext>].
+var encryptedRegexp = regexp.MustCompile(`^ENC\[AGE,([A-Za-z0-9+/=]*)\]$`)
+
+// A field whose values are encrypted in Git.
+type EncryptedField struct {
+	Kind string
+	// Dot separated path of the field. Every string below the field is encrypted.
+	Path string
+}
+
+// The fields encrypted when no fields are configured.
+var DefaultEncryptedFields = []EncryptedField{
+	{Kind: "Secret", Path: "data"},
+	{Kind: "Secret", Path: "stringData"},
+}
+
+// Encrypts the values of fields with age when objects are written and decrypts them
+// when objects are loaded, so that objects in memory only hold plaintext.
+type Encryption struct {
+	// The recipients values are encrypted for.
+	Recipients []age.Recipient
+	// The identities used to decrypt values.
+	Identities []age.Identity
+	Fields     []EncryptedField
+}
+
+// Create an encryption from age recipients and a file of age identities. If fields
+// is empty, the data and stringData of Secrets are encrypted.
+func NewEncryption(recipients []string, identities string, fields []EncryptedField) (*Encryption, error) {
+	e := &Encryption{
+		Fields: fields,
+	}
+
+	if len(e.Fields) == 0 {
+		e.Fields = DefaultEncryptedFields
+	}
+
+	for _, recipient := range recipients {
+		parsed, err := age.ParseX25519Recipient(recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Recipients = append(e.Recipients, parsed)
+	}
+
+	if identities != "" {
+		parsed, err := age.ParseIdentities(strings.NewReader(identities))
+		if err != nil {
+			return nil, err
+		}
+
+		e.Identities = parsed
+	}
+
+	return e, nil
+}
+
+// Return true if any fields of objects of kind are encrypted.
+func (e *Encryption) hasFields(kind string) bool {
+	if e == nil {
+		return false
+	}
+
+	for _, field := range e.Fields {
+		if field.Kind == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the paths of the fields of objects of kind that are encrypted.
+func (e *Encryption) fieldPaths(kind string) []string {
+	paths := []string{}
+
+	if e == nil {
+		return paths
+	}
+
+	for _, field := range e.Fields {
+		if field.Kind == kind {
+			paths = append(paths, field.Path)
+		}
+	}
+
+	return paths
+}
+
+// Decrypt a value if it is encrypted, returning true if it was.
+func (e *Encryption) decryptString(s string) (string, bool, error) {
+	match := encryptedRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return s, false, nil
+	}
+
+	if e == nil || len(e.Identities) == 0 {
+		return "", true, errors.New("value is encrypted but no key is configured to decrypt it")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(match[1])
+	if err != nil {
+		return "", true, fmt.Errorf("could not decrypt value: %s", err)
+	}
+
+	reader, err := age.Decrypt(bytes.NewReader(ciphertext), e.Identities...)
+	if err != nil {
+		return "", true, fmt.Errorf("could not decrypt value: %s", err)
+	}
+
+	plaintext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", true, fmt.Errorf("could not decrypt value: %s", err)
+	}
+
+	return string(plaintext), true, nil
+}
+
+// Encrypt a value for the recipients.
+func (e *Encryption) encryptString(s string) (string, error) {
+	if e == nil || len(e.Recipients) == 0 {
+		return "", errors.New("no recipients are configured to encrypt values for")
+	}
+
+	ciphertext := &bytes.Buffer{}
+
+	writer, err := age.Encrypt(ciphertext, e.Recipients...)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := writer.Write([]byte(s)); err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return "ENC[AGE," + base64.StdEncoding.EncodeToString(ciphertext.Bytes()) + "]", nil
+}
+
+// Return a copy of value with every encrypted string decrypted. Encrypted values
+// are an error if there are no identities to decrypt them with, so that ciphertext
+// is never mistaken for a value.
+func (e *Encryption) Decrypt(value interface{}) (interface{}, error) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		decrypted := map[string]interface{}{}
+
+		for key, item := range typed {
+			decryptedItem, err := e.Decrypt(item)
+			if err != nil {
+				return nil, err
+			}
+
+			decrypted[key] = decryptedItem
+		}
+
+		return decrypted, nil
+	case []interface{}:
+		decrypted := []interface{}{}
+
+		for _, item := range typed {
+			decryptedItem, err := e.Decrypt(item)
+			if err != nil {
+				return nil, err
+			}
+
+			decrypted = append(decrypted, decryptedItem)
+		}
+
+		return decrypted, nil
+	case string:
+		decrypted, _, err := e.decryptString(typed)
+		return decrypted, err
+	}
+
+	return value, nil
+}
+
+// Return a copy of value with the strings in the configured fields, and the strings
+// that were encrypted in template, encrypted. Strings that have the same value as
+// when they were loaded keep their ciphertext from template so that writing an
+// object does not change every encrypted value.
+func (e *Encryption) Encrypt(template, value map[string]interface{}) (map[string]interface{}, error) {
+	kind, _ := value["kind"].(string)
+
+	encrypted, err := e.encrypt(template, value, []string{}, e.fieldPaths(kind), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypted.(map[string]interface{}), nil
+}
+
+// Encrypt value, which is at path in the object. If force is true, value is below
+// an encrypted field.
+func (e *Encryption) encrypt(template, value interface{}, path, fields []string, force bool) (interface{}, error) {
+	force = force || containsPath(fields, path)
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		templateMap, _ := template.(map[string]interface{})
+		encrypted := map[string]interface{}{}
+
+		for key, item := range typed {
+			encryptedItem, err := e.encrypt(templateMap[key], item, append(path[:len(path):len(path)], key), fields, force)
+			if err != nil {
+				return nil, err
+			}
+
+			encrypted[key] = encryptedItem
+		}
+
+		return encrypted, nil
+	case []interface{}:
+		templateSlice, _ := template.([]interface{})
+		encrypted := []interface{}{}
+
+		for i, item := range typed {
+			var templateItem interface{}
+			if i < len(templateSlice) {
+				templateItem = templateSlice[i]
+			}
+
+			encryptedItem, err := e.encrypt(templateItem, item, path, fields, force)
+			if err != nil {
+				return nil, err
+			}
+
+			encrypted = append(encrypted, encryptedItem)
+		}
+
+		return encrypted, nil
+	case string:
+		// Redacted values have nothing left to protect.
+		if redactedRegexp.MatchString(typed) {
+			return value, nil
+		}
+
+		if templateString, ok := template.(string); ok {
+			plaintext, wasEncrypted, err := e.decryptString(templateString)
+			if wasEncrypted && err == nil && plaintext == typed {
+				return templateString, nil
+			}
+
+			force = force || wasEncrypted
+		}
+
+		if force {
+			return e.encryptString(typed)
+		}
+	}
+
+	return value, nil
+}
+
+// The values that replace encrypted strings in masked objects. Strings that changed
+// get a different marker, so that a patch between masked objects still shows which
+// encrypted fields changed.
+const (
+	maskedValue        = "ENCRYPTED"
+	changedMaskedValue = "ENCRYPTED[changed]"
+)
+
+// Return a copy of value with the strings that would be encrypted when it is
+// written, those in the configured fields and those that were encrypted in
+// template, replaced with markers. original is the plaintext of template.
+func (e *Encryption) Mask(template, original, value map[string]interface{}) map[string]interface{} {
+	kind, _ := value["kind"].(string)
+	return e.mask(template, original, value, []string{}, e.fieldPaths(kind), false).(map[string]interface{})
+}
+
+// Mask value, which is at path in the object. If force is true, value is below an
+// encrypted field.
+func (e *Encryption) mask(template, original, value interface{}, path, fields []string, force bool) interface{} {
+	force = force || containsPath(fields, path)
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		templateMap, _ := template.(map[string]interface{})
+		originalMap, _ := original.(map[string]interface{})
+		masked := map[string]interface{}{}
+
+		for key, item := range typed {
+			masked[key] = e.mask(templateMap[key], originalMap[key], item, append(path[:len(path):len(path)], key), fields, force)
+		}
+
+		return masked
+	case []interface{}:
+		templateSlice, _ := template.([]interface{})
+		originalSlice, _ := original.([]interface{})
+		masked := []interface{}{}
+
+		for i, item := range typed {
+			var templateItem, originalItem interface{}
+			if i < len(templateSlice) {
+				templateItem = templateSlice[i]
+			}
+
+			if i < len(originalSlice) {
+				originalItem = originalSlice[i]
+			}
+
+			masked = append(masked, e.mask(templateItem, originalItem, item, path, fields, force))
+		}
+
+		return masked
+	case string:
+		if redactedRegexp.MatchString(typed) {
+			return value
+		}
+
+		if templateString, ok := template.(string); ok && encryptedRegexp.MatchString(templateString) {
+			force = true
+		}
+
+		if !force {
+			return value
+		}
+
+		if originalString, ok := original.(string); ok && originalString == typed {
+			return maskedValue
+		}
+
+		return changedMaskedValue
+	}
+
+	return value
+}
+
+// Return true if path is one of the dot separated paths in fields.
+func containsPath(fields, path []string) bool {
+	joined := strings.Join(path, ".")
+
+	for _, field := range fields {
+		if field == joined {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,91 @@
+package yaml
+
+import (
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	encryption, err := NewEncryption([]string{identity.Recipient().String()}, identity.String(), nil)
+	assert.Nil(t, err)
+
+	fs := memfs.New()
+
+	file := NewFile(fs, "secret.yaml")
+	file.Encryption = encryption
+	file.AddResource(&Object{Object: &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":      "database",
+			"namespace": "default",
+		},
+		"type": "Opaque",
+		"data": map[string]interface{}{
+			"password": "aHVudGVyMg==",
+			"username": "YWRtaW4=",
+		},
+	}}})
+	assert.Nil(t, file.Dump())
+
+	written := readFile(t, fs, "secret.yaml")
+	assert.NotContains(t, written, "aHVudGVyMg==")
+	assert.NotContains(t, written, "YWRtaW4=")
+	assert.Contains(t, written, "type: Opaque")
+
+	file = NewFile(fs, "secret.yaml")
+	file.Encryption = encryption
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+
+	obj := objects[0].Object.(*unstructured.Unstructured)
+	assert.Equal(t, map[string]interface{}{
+		"password": "aHVudGVyMg==",
+		"username": "YWRtaW4=",
+	}, obj.Object["data"])
+	assert.False(t, objects[0].Changed())
+
+	// Masked objects show which encrypted values changed, but not their values.
+	changed := obj.DeepCopy()
+	unstructured.SetNestedField(changed.Object, "c2VjcmV0", "data", "password")
+
+	masked, maskedOriginal, err := objects[0].MaskEncrypted(changed)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"password": "ENCRYPTED[changed]",
+		"username": "ENCRYPTED",
+	}, masked.(*unstructured.Unstructured).Object["data"])
+	assert.Equal(t, map[string]interface{}{
+		"password": "ENCRYPTED",
+		"username": "ENCRYPTED",
+	}, maskedOriginal.(*unstructured.Unstructured).Object["data"])
+	assert.Equal(t, "Opaque", masked.(*unstructured.Unstructured).Object["type"])
+
+	// Unchanged values keep their ciphertext.
+	username := objects[0].encrypted["data"].(map[string]interface{})["username"].(string)
+	password := objects[0].encrypted["data"].(map[string]interface{})["password"].(string)
+
+	obj = obj.DeepCopy()
+	unstructured.SetNestedField(obj.Object, "c2VjcmV0", "data", "password")
+	objects[0].SetObject(obj)
+	assert.Nil(t, objects[0].Save())
+
+	written = readFile(t, fs, "secret.yaml")
+	assert.Contains(t, written, username)
+	assert.NotContains(t, written, password)
+	assert.NotContains(t, written, "c2VjcmV0")
+
+	// Without a key, the secret cannot be loaded.
+	file = NewFile(fs, "secret.yaml")
+	objects, err = file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(objects))
+	assert.Equal(t, 1, len(file.Invalid))
+}
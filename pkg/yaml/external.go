@@ -0,0 +1,416 @@
+package yaml
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/justinbarrick/gitops-controller/pkg/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The annotations listing the fields of an object that are stored in separate
+// files. Their values are JSON objects mapping each field, such as
+// `data/script.sh`, to the path of its file relative to the manifest. Fields in the
+// binary annotation are base64 encoded in the object and decoded in their file.
+const (
+	FilesAnnotation       = "gitops-controller/files"
+	BinaryFilesAnnotation = "gitops-controller/binary-files"
+)
+
+// A string field whose values are stored in separate files.
+type ExternalField struct {
+	Kind string
+	// Dot separated path of the field. If the field is a map, each of its values is
+	// stored in a file named after its key.
+	Path string
+	// If true, the values are base64 encoded and their files hold the decoded
+	// contents.
+	Binary bool
+}
+
+// Settings for storing string fields in separate files next to their manifest.
+type ExternalFiles struct {
+	Fields []ExternalField
+	// Values shorter than this many bytes are kept in the manifest.
+	MinSize int
+}
+
+// Split a reference to a field into the path of the field, followed by the key if
+// the reference is to a value in a map.
+func splitReference(ref string) []string {
+	parts := strings.SplitN(ref, "/", 2)
+
+	fields := strings.Split(parts[0], ".")
+	if len(parts) == 2 {
+		fields = append(fields, parts[1])
+	}
+
+	return fields
+}
+
+// Return the path of a file referenced by an object in the file.
+func (y *File) externalPath(path string) (string, error) {
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+		return "", fmt.Errorf("file %s is outside of the directory of %s", path, y.Path)
+	}
+
+	return filepath.Join(filepath.Dir(y.Path), path), nil
+}
+
+// Return the fields of obj that are referenced by the files annotations, mapped to
+// their files.
+func readFilesAnnotations(obj *unstructured.Unstructured) (map[string]string, map[string]bool, error) {
+	files := map[string]string{}
+	binary := map[string]bool{}
+
+	for _, annotation := range []string{FilesAnnotation, BinaryFilesAnnotation} {
+		encoded, ok := obj.GetAnnotations()[annotation]
+		if !ok {
+			continue
+		}
+
+		refs := map[string]string{}
+		if err := json.Unmarshal([]byte(encoded), &refs); err != nil {
+			return nil, nil, fmt.Errorf("invalid %s annotation: %s", annotation, err)
+		}
+
+		for ref, path := range refs {
+			files[ref] = path
+			binary[ref] = annotation == BinaryFilesAnnotation
+		}
+	}
+
+	return files, binary, nil
+}
+
+// Set the files annotations of obj, removing them if there are no files.
+func writeFilesAnnotations(obj *unstructured.Unstructured, files map[string]string, binary map[string]bool) error {
+	annotations := obj.GetAnnotations()
+	delete(annotations, FilesAnnotation)
+	delete(annotations, BinaryFilesAnnotation)
+
+	for _, annotation := range []string{FilesAnnotation, BinaryFilesAnnotation} {
+		refs := map[string]string{}
+		for ref, path := range files {
+			if binary[ref] == (annotation == BinaryFilesAnnotation) {
+				refs[ref] = path
+			}
+		}
+
+		if len(refs) == 0 {
+			continue
+		}
+
+		encoded, err := json.Marshal(refs)
+		if err != nil {
+			return err
+		}
+
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+
+		annotations[annotation] = string(encoded)
+	}
+
+	if len(annotations) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+	} else {
+		obj.SetAnnotations(annotations)
+	}
+
+	return nil
+}
+
+// Return a copy of obj with the fields listed in its files annotations set to the
+// contents of their files and the annotations removed, along with the files by
+// field. Returns obj if it does not reference any files.
+func (y *File) inlineFiles(obj *unstructured.Unstructured) (*unstructured.Unstructured, map[string]string, error) {
+	files, binary, err := readFilesAnnotations(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(files) == 0 {
+		return obj, nil, nil
+	}
+
+	obj = obj.DeepCopy()
+
+	for ref, path := range files {
+		fullPath, err := y.externalPath(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		contents, err := util.ReadFile(y.fs, fullPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value := string(contents)
+		if binary[ref] {
+			value = base64.StdEncoding.EncodeToString(contents)
+		}
+
+		if err := unstructured.SetNestedField(obj.Object, value, splitReference(ref)...); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := writeFilesAnnotations(obj, nil, nil); err != nil {
+		return nil, nil, err
+	}
+
+	return obj, files, nil
+}
+
+// Return true if any fields of objects of kind are stored in separate files.
+func (e *ExternalFiles) hasFields(kind string) bool {
+	if e == nil {
+		return false
+	}
+
+	for _, field := range e.Fields {
+		if field.Kind == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Move the values of the configured fields of value to separate files, replacing
+// them with references in the files annotations. Fields keep the file they were
+// loaded from, if any, and new files are named after the object's kind and name and
+// the key or field, so that objects of different kinds in a directory do not share
+// files. Returns the fields mapped to their files and the contents of each file.
+func (e *ExternalFiles) externalize(value map[string]interface{}, previous map[string]string) (map[string]string, map[string][]byte, error) {
+	obj := &unstructured.Unstructured{Object: value}
+
+	files := map[string]string{}
+	binary := map[string]bool{}
+	contents := map[string][]byte{}
+
+	// Adds a string value to the files, returning false if it must stay inline.
+	add := func(ref, defaultPath string, field ExternalField, value interface{}) bool {
+		s, ok := value.(string)
+		if !ok || len(s) < e.MinSize {
+			return false
+		}
+
+		data := []byte(s)
+		if field.Binary {
+			decoded, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return false
+			}
+
+			data = decoded
+		}
+
+		path, ok := previous[ref]
+		if !ok {
+			path = filepath.Join(strings.ToLower(obj.GetKind()), obj.GetName(), defaultPath)
+		}
+
+		files[ref] = path
+		binary[ref] = field.Binary
+		contents[path] = data
+		return true
+	}
+
+	if e != nil {
+		for _, field := range e.Fields {
+			if field.Kind != obj.GetKind() {
+				continue
+			}
+
+			fields := strings.Split(field.Path, ".")
+
+			fieldValue, ok, _ := unstructured.NestedFieldNoCopy(value, fields...)
+			if !ok {
+				continue
+			}
+
+			if values, ok := fieldValue.(map[string]interface{}); ok {
+				for key, item := range values {
+					if add(field.Path+"/"+key, key, field, item) {
+						delete(values, key)
+					}
+				}
+
+				if len(values) == 0 {
+					unstructured.RemoveNestedField(value, fields...)
+				}
+			} else if add(field.Path, field.Path, field, fieldValue) {
+				unstructured.RemoveNestedField(value, fields...)
+			}
+		}
+	}
+
+	if err := writeFilesAnnotations(obj, files, binary); err != nil {
+		return nil, nil, err
+	}
+
+	return files, contents, nil
+}
+
+// Return an error if an object in the file writes a file that another object in the
+// file references, or a new file that already exists and so belongs to another
+// manifest or to no manifest at all. Must be called after the objects are
+// serialized.
+func (y *File) checkFiles() error {
+	// The files of removed objects are only removed after the manifest is written,
+	// so they may be reused.
+	removed := map[string]bool{}
+	for _, path := range y.removedFiles {
+		removed[path] = true
+	}
+
+	owners := map[string]*Object{}
+	for _, obj := range y.Objects {
+		for _, path := range obj.files {
+			owners[path] = obj
+		}
+	}
+
+	for _, obj := range y.Objects {
+		for path := range obj.contents {
+			owner, ok := owners[path]
+			if ok && owner != obj {
+				return fmt.Errorf("%s: file %s of %s %s is already a file of %s %s", y.Path, path,
+					util.GetType(obj.Object).Kind, obj.Name(), util.GetType(owner.Object).Kind, owner.Name())
+			}
+
+			if ok || removed[path] {
+				owners[path] = obj
+				continue
+			}
+
+			fullPath, err := y.externalPath(path)
+			if err != nil {
+				return err
+			}
+
+			if _, err := y.fs.Stat(fullPath); err == nil {
+				return fmt.Errorf("%s: file %s of %s %s already exists", y.Path, path,
+					util.GetType(obj.Object).Kind, obj.Name())
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+
+			owners[path] = obj
+		}
+	}
+
+	return nil
+}
+
+// Write the files of an object that was written to the manifest and remove the
+// files it no longer references.
+func (y *File) writeFiles(obj *Object) error {
+	if obj.contents == nil {
+		return nil
+	}
+
+	for path, data := range obj.contents {
+		fullPath, err := y.externalPath(path)
+		if err != nil {
+			return err
+		}
+
+		if err := y.fs.MkdirAll(filepath.Dir(fullPath), 0700); err != nil {
+			return err
+		}
+
+		outFile, err := y.fs.Create(fullPath)
+		if err != nil {
+			return err
+		}
+
+		_, err = outFile.Write(data)
+		outFile.Close()
+		if err != nil {
+			return err
+		}
+
+		y.changedFiles = append(y.changedFiles, fullPath)
+	}
+
+	for _, path := range obj.files {
+		if _, ok := obj.contents[path]; !ok {
+			if err := y.removeFile(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	obj.files = obj.newFiles
+	obj.contents = nil
+	return nil
+}
+
+// Remove a file that is no longer referenced by an object.
+func (y *File) removeFile(path string) error {
+	fullPath, err := y.externalPath(path)
+	if err != nil {
+		return err
+	}
+
+	if err := y.fs.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	y.changedFiles = append(y.changedFiles, fullPath)
+	return nil
+}
+
+// Remove the files of the objects removed from the file, unless another object
+// has written to them since.
+func (y *File) removeFiles() error {
+	owned := map[string]bool{}
+	for _, obj := range y.Objects {
+		for _, path := range obj.files {
+			owned[path] = true
+		}
+	}
+
+	for _, path := range y.removedFiles {
+		if owned[path] {
+			continue
+		}
+
+		if err := y.removeFile(path); err != nil {
+			return err
+		}
+	}
+
+	y.removedFiles = nil
+	return nil
+}
+
+// Return the paths of the files referenced by the objects in the file.
+func (y *File) ExternalFiles() []string {
+	paths := []string{}
+
+	for _, obj := range y.Objects {
+		for _, path := range obj.files {
+			if fullPath, err := y.externalPath(path); err == nil {
+				paths = append(paths, fullPath)
+			}
+		}
+	}
+
+	return paths
+}
+
+// Return the paths of the files that were written or removed alongside the
+// manifest the last time it was written.
+func (y *File) ChangedFiles() []string {
+	return y.changedFiles
+}
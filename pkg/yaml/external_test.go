@@ -0,0 +1,210 @@
+package yaml
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sort"
+	"testing"
+)
+
+func TestExternalFiles(t *testing.T) {
+	fs := memfs.New()
+	external := &ExternalFiles{
+		Fields: []ExternalField{
+			{Kind: "ConfigMap", Path: "data"},
+			{Kind: "ConfigMap", Path: "binaryData", Binary: true},
+		},
+	}
+
+	file := NewFile(fs, "default/config.yaml")
+	file.External = external
+	file.AddResource(&Object{Object: &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      "frontend",
+			"namespace": "default",
+		},
+		"data": map[string]interface{}{
+			"nginx.conf": "server {\n  listen 80;\n}\n",
+		},
+		"binaryData": map[string]interface{}{
+			"logo.png": "iVBORw0K",
+		},
+	}}})
+
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  annotations:
+    gitops-controller/binary-files: '{"binaryData/logo.png":"configmap/frontend/logo.png"}'
+    gitops-controller/files: '{"data/nginx.conf":"configmap/frontend/nginx.conf"}'
+  name: frontend
+  namespace: default
+`, readFile(t, fs, "default/config.yaml"))
+	assert.Equal(t, "server {\n  listen 80;\n}\n", readFile(t, fs, "default/configmap/frontend/nginx.conf"))
+	assert.Equal(t, "\x89PNG\r\n", readFile(t, fs, "default/configmap/frontend/logo.png"))
+	assert.Equal(t, []string{"default/configmap/frontend/logo.png", "default/configmap/frontend/nginx.conf"},
+		sorted(file.ChangedFiles()))
+
+	file = NewFile(fs, "default/config.yaml")
+	file.External = external
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, []string{"default/configmap/frontend/logo.png", "default/configmap/frontend/nginx.conf"},
+		sorted(file.ExternalFiles()))
+
+	obj := objects[0].Object.(*unstructured.Unstructured)
+	assert.Equal(t, map[string]interface{}{
+		"nginx.conf": "server {\n  listen 80;\n}\n",
+	}, obj.Object["data"])
+	assert.Equal(t, map[string]interface{}{
+		"logo.png": "iVBORw0K",
+	}, obj.Object["binaryData"])
+	assert.Nil(t, obj.GetAnnotations())
+	assert.False(t, objects[0].Changed())
+
+	obj = obj.DeepCopy()
+	unstructured.SetNestedField(obj.Object, "server {\n  listen 8080;\n}\n", "data", "nginx.conf")
+	unstructured.RemoveNestedField(obj.Object, "binaryData")
+	objects[0].SetObject(obj)
+
+	assert.Nil(t, objects[0].Save())
+	assert.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  annotations:
+    gitops-controller/files: '{"data/nginx.conf":"configmap/frontend/nginx.conf"}'
+  name: frontend
+  namespace: default
+`, readFile(t, fs, "default/config.yaml"))
+	assert.Equal(t, "server {\n  listen 8080;\n}\n", readFile(t, fs, "default/configmap/frontend/nginx.conf"))
+
+	_, err = fs.Stat("default/configmap/frontend/logo.png")
+	assert.NotNil(t, err)
+
+	objects[0].Delete()
+
+	_, err = fs.Stat("default/configmap/frontend/nginx.conf")
+	assert.NotNil(t, err)
+}
+
+func TestExternalFileMissing(t *testing.T) {
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "config.yaml", []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: frontend
+  annotations:
+    gitops-controller/files: '{"data/nginx.conf":"frontend/nginx.conf"}'
+`), 0644))
+
+	file := NewFile(fs, "config.yaml")
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(objects))
+	assert.Equal(t, 1, len(file.Invalid))
+}
+
+func TestExternalFilesOfOtherObjects(t *testing.T) {
+	fs := memfs.New()
+	external := &ExternalFiles{
+		Fields: []ExternalField{
+			{Kind: "ConfigMap", Path: "data"},
+			{Kind: "Secret", Path: "stringData"},
+		},
+	}
+
+	object := func(kind, field string) *Object {
+		return &Object{Object: &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       kind,
+			"metadata": map[string]interface{}{
+				"name":      "frontend",
+				"namespace": "default",
+			},
+			field: map[string]interface{}{
+				"config": "listen 80\n",
+			},
+		}}}
+	}
+
+	// Objects of different kinds with the same name do not share files.
+	file := NewFile(fs, "default/frontend.yaml")
+	file.External = external
+	file.AddResource(object("ConfigMap", "data"))
+	file.AddResource(object("Secret", "stringData"))
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, []string{"default/configmap/frontend/config", "default/secret/frontend/config"},
+		sorted(file.ChangedFiles()))
+
+	// A new file is never written over a file that already exists.
+	file = NewFile(fs, "default/other.yaml")
+	file.External = external
+	file.AddResource(object("ConfigMap", "data"))
+	assert.NotNil(t, file.Dump())
+
+	_, err := fs.Stat("default/other.yaml")
+	assert.NotNil(t, err)
+}
+
+func TestExternalFilesOfRemovedObjects(t *testing.T) {
+	fs := memfs.New()
+	external := &ExternalFiles{
+		Fields: []ExternalField{
+			{Kind: "ConfigMap", Path: "data"},
+		},
+	}
+
+	object := func(name, config string) *Object {
+		return &Object{Object: &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "default",
+			},
+			"data": map[string]interface{}{
+				"config": config,
+			},
+		}}}
+	}
+
+	file := NewFile(fs, "default/config.yaml")
+	file.External = external
+	file.AddResource(object("frontend", "listen 80\n"))
+	assert.Nil(t, file.Dump())
+
+	assert.Nil(t, util.WriteFile(fs, "default/configmap/backend/config", []byte("listen 81\n"), 0644))
+
+	// The files of a removed object are kept if the manifest cannot be written.
+	file = NewFile(fs, "default/config.yaml")
+	file.External = external
+	_, err := file.Load()
+	assert.Nil(t, err)
+
+	file.RemoveResource(object("frontend", ""))
+	file.AddResource(object("backend", "listen 82\n"))
+	assert.NotNil(t, file.Dump())
+	assert.Equal(t, "listen 80\n", readFile(t, fs, "default/configmap/frontend/config"))
+
+	// The files of a removed object can be reused by a new object.
+	file = NewFile(fs, "default/config.yaml")
+	file.External = external
+	_, err = file.Load()
+	assert.Nil(t, err)
+
+	file.RemoveResource(object("frontend", ""))
+	file.AddResource(object("frontend", "listen 8080\n"))
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, "listen 8080\n", readFile(t, fs, "default/configmap/frontend/config"))
+}
+
+func sorted(paths []string) []string {
+	sort.Strings(paths)
+	return paths
+}
@@ -1,11 +1,13 @@
 package yaml
 
 import (
-	"bufio"
 	"bytes"
+	"fmt"
 	"github.com/justinbarrick/gitops-controller/pkg/util"
+	yaml3 "go.yaml.in/yaml/v3"
 	"gopkg.in/src-d/go-billy.v4"
 	"io"
+	"io/ioutil"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"os"
@@ -18,6 +20,51 @@ type File struct {
 	Objects []*Object
 	Path    string
 	fs      billy.Filesystem
+	// Separators and comments after the last document in the file.
+	trailer []byte
+	// If set, the objects were rendered by this generator rather than loaded from
+	// a manifest and cannot be written back.
+	Generator string
+	// If set, placeholders in the file are expanded when it is loaded and put back
+	// when it is written.
+	Variables *Variables
+	// Documents that could not be loaded. They are kept in the file when it is
+	// written.
+	Invalid []*InvalidDocument
+	// If set, the configured fields are redacted when the file is written.
+	Redaction *Redaction
+	// If set, the configured fields are encrypted when the file is written and
+	// encrypted values are decrypted when it is loaded. If not set, loading an
+	// object with encrypted values fails.
+	Encryption *Encryption
+	// If set, the configured fields are written to separate files next to the
+	// manifest. Files referenced by objects are always read when loading.
+	External *ExternalFiles
+	// Files of removed objects that are deleted when the file is written, and the
+	// files written or deleted the last time it was written.
+	removedFiles []string
+	changedFiles []string
+}
+
+// A document in a file that could not be loaded as an object.
+type InvalidDocument struct {
+	Path string `json:"path"`
+	// The line the document starts on, if the document is in a manifest.
+	Line  int    `json:"line,omitempty"`
+	Error string `json:"error"`
+	// The objects defined by the document, if it could be decoded far enough to
+	// identify them.
+	Objects []*unstructured.Unstructured `json:"-"`
+}
+
+// Returned when trying to write objects that were rendered by a generator.
+type GeneratedError struct {
+	Path      string
+	Generator string
+}
+
+func (e *GeneratedError) Error() string {
+	return fmt.Sprintf("%s is generated by %s and cannot be written to", e.Path, e.Generator)
 }
 
 // Instantiate a new YAML file.
@@ -37,13 +84,38 @@ func (y *File) AddResource(obj *Object) {
 		}
 	}
 
+	// Invalid documents at the end of the file stay in front of the new object so
+	// that the documents are kept in order.
+	if holdsDocuments(y.trailer) {
+		obj.preceding = withNewline(y.trailer)
+		y.trailer = []byte{}
+	}
+
 	y.Objects = append(y.Objects, obj)
 	obj.File = y
 }
 
+// Return true if data holds any documents rather than only separators and
+// comments.
+func holdsDocuments(data []byte) bool {
+	documents, _ := splitDocuments(data)
+	return len(documents) != 0
+}
+
+// Return data ending with a newline.
+func withNewline(data []byte) []byte {
+	if len(data) == 0 || bytes.HasSuffix(data, []byte("\n")) {
+		return data
+	}
+
+	return append(append([]byte{}, data...), '\n')
+}
+
 // Remove a resource from the file.
 func (y *File) RemoveResource(obj *Object) {
 	objects := []*Object{}
+	// Invalid documents preceding removed objects.
+	preceding := []byte{}
 
 	for _, object := range y.Objects {
 		if object.Matches(obj.Object) {
@@ -52,15 +124,198 @@ func (y *File) RemoveResource(obj *Object) {
 
 			util.Log.Info("pruning resource", "name", meta.GetName(), "namespace",
 				meta.GetNamespace(), "kind", kind.Kind)
+
+			for _, path := range object.files {
+				y.removedFiles = append(y.removedFiles, path)
+			}
+
+			if object.list == nil {
+				preceding = append(preceding, object.preceding...)
+				continue
+			}
+
+			// Lists are removed from the file once they are empty.
+			object.list.remove(object)
+			if len(object.list.items) == 0 {
+				preceding = append(preceding, object.list.preceding...)
+			}
+
 			continue
 		}
 
+		if len(preceding) != 0 {
+			if object.list != nil {
+				object.list.preceding = append(preceding, object.list.preceding...)
+			} else {
+				object.preceding = append(preceding, object.preceding...)
+			}
+
+			preceding = []byte{}
+		}
+
 		objects = append(objects, object)
 	}
 
+	y.trailer = append(preceding, y.trailer...)
 	y.Objects = objects
 }
 
+// Return an error if obj is not a valid Kubernetes object.
+func validateObject(obj *unstructured.Unstructured) error {
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"apiVersion", obj.GetAPIVersion()},
+		{"kind", obj.GetKind()},
+		{"metadata.name", obj.GetName()},
+	} {
+		if field.value == "" {
+			return fmt.Errorf("document is missing %s", field.name)
+		}
+	}
+
+	return nil
+}
+
+// Decode the objects in a document. If the document is a List or an array, the
+// list is returned along with its items.
+func decodeDocument(data []byte) ([]*unstructured.Unstructured, *list, error) {
+	decodedList, array, err := decodeList(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if decodedList != nil {
+		objects := []*unstructured.Unstructured{}
+
+		for i := range decodedList.Items {
+			objects = append(objects, &decodedList.Items[i])
+		}
+
+		l := &list{}
+		if !array {
+			l.object = decodedList.Object
+		}
+
+		return objects, l, nil
+	}
+
+	obj := &unstructured.Unstructured{}
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer(data), len(data))
+
+	if err := decoder.Decode(obj); err != nil {
+		return nil, nil, err
+	}
+
+	return []*unstructured.Unstructured{obj}, nil, nil
+}
+
+// Return the objects in a document that could not be loaded, if it can be decoded
+// and every object in it has a kind and a name.
+func identifyDocument(data []byte) []*unstructured.Unstructured {
+	decoded, _, err := decodeDocument(data)
+	if err != nil {
+		return nil
+	}
+
+	for _, obj := range decoded {
+		if obj.GetKind() == "" || obj.GetName() == "" {
+			return nil
+		}
+	}
+
+	return decoded
+}
+
+// Create an object loaded from the file, reading any fields stored in separate
+// files, decrypting any encrypted values and expanding any placeholders. node is
+// the node of the object in the document, or nil if it is not known.
+func (y *File) newObject(obj *unstructured.Unstructured, node *yaml3.Node) (*Object, error) {
+	var template, encrypted map[string]interface{}
+
+	obj, files, err := y.inlineFiles(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := y.Encryption.Decrypt(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	if y.Encryption != nil {
+		encrypted = obj.Object
+		obj = &unstructured.Unstructured{Object: decrypted.(map[string]interface{})}
+	}
+
+	if y.Variables != nil {
+		template = obj.Object
+
+		expanded, err := y.Variables.Expand(template, node)
+		if err != nil {
+			return nil, err
+		}
+
+		obj = &unstructured.Unstructured{Object: expanded.(map[string]interface{})}
+	}
+
+	if err := validateObject(obj); err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		File:      y,
+		Object:    obj,
+		original:  obj.DeepCopyObject(),
+		template:  template,
+		encrypted: encrypted,
+		files:     files,
+	}, nil
+}
+
+// Return the node of object i of a document, or nil if it cannot be found.
+func objectNode(root *yaml3.Node, l *list, i int) *yaml3.Node {
+	if root == nil {
+		return nil
+	}
+
+	if l == nil {
+		return root.Content[0]
+	}
+
+	return sequenceItem((&list{node: root, object: l.object}).itemsNode(), i)
+}
+
+// Load the objects in a document. If the document is a list, the objects are
+// its items.
+func (y *File) loadDocument(document document) ([]*Object, *list, error) {
+	decoded, l, err := decodeDocument(document.data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root := parseNode(document.data)
+
+	objects := []*Object{}
+	for i, obj := range decoded {
+		object, err := y.newObject(obj, objectNode(root, l, i))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if l != nil {
+			object.list = l
+			object.raw = obj.Object
+			object.listIndex = i
+		}
+
+		objects = append(objects, object)
+	}
+
+	return objects, l, nil
+}
+
 // Load all objects from a YAML file.
 func (y *File) Load() ([]*Object, error) {
 	opened, err := y.fs.Open(y.Path)
@@ -69,60 +324,127 @@ func (y *File) Load() ([]*Object, error) {
 	}
 	defer opened.Close()
 
-	yamlReader := yaml.NewYAMLReader(bufio.NewReader(opened))
+	contents, err := ioutil.ReadAll(opened)
+	if err != nil {
+		return nil, err
+	}
+
+	documents, trailer := splitDocuments(contents)
+	y.Invalid = []*InvalidDocument{}
+
+	// Invalid documents that have not been attached to an object yet.
+	preceding := []byte{}
+	line := 1
 
-	for {
-		data, err := yamlReader.Read()
+	for _, document := range documents {
+		dataLine := line + bytes.Count(document.separator, []byte("\n"))
+		line = dataLine + bytes.Count(document.data, []byte("\n"))
+
+		objects, l, err := y.loadDocument(document)
 		if err != nil {
-			if err == io.EOF {
-				return y.Objects, nil
-			}
-			return nil, err
+			util.Log.Error(err, "skipping invalid document", "path", y.Path, "line", dataLine)
+			y.Invalid = append(y.Invalid, &InvalidDocument{
+				Path:    y.Path,
+				Line:    dataLine,
+				Error:   err.Error(),
+				Objects: identifyDocument(document.data),
+			})
+
+			preceding = append(preceding, document.separator...)
+			preceding = append(preceding, document.data...)
+			continue
 		}
 
-		obj := &unstructured.Unstructured{}
-		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer(data), len(data))
+		var node *yaml3.Node
 
-		if err = decoder.Decode(obj); err != nil {
-			return nil, err
+		// JSON documents are re-encoded in full when they change.
+		if filepath.Ext(y.Path) != ".json" {
+			node = parseNode(document.data)
+		}
+
+		if l != nil {
+			l.items = objects
+			l.loaded = len(objects)
+			l.node = node
+			l.preceding = preceding
+			l.separator = document.separator
+			l.data = document.data
+		} else {
+			objects[0].node = node
+			objects[0].preceding = preceding
+			objects[0].separator = document.separator
+			objects[0].data = document.data
 		}
 
-		y.Objects = append(y.Objects, &Object{
-			File:   y,
-			Object: obj,
-		})
+		preceding = []byte{}
+		y.Objects = append(y.Objects, objects...)
 	}
 
+	y.trailer = append(preceding, trailer...)
 	return y.Objects, nil
 }
 
 // Serialize all objects to a file, or remove the file if there are no objects
 // left.
 func (y *File) Dump() error {
-	if len(y.Objects) == 0 {
-		if _, err := y.fs.Stat(y.Path); os.IsNotExist(err) {
-			return nil
-		} else if err != nil {
+	if y.Generator != "" {
+		return &GeneratedError{Path: y.Path, Generator: y.Generator}
+	}
+
+	y.changedFiles = []string{}
+
+	// Files with invalid documents are kept so that the documents are not lost.
+	if len(y.Objects) == 0 && len(y.Invalid) == 0 {
+		if _, err := y.fs.Stat(y.Path); err == nil {
+			util.Log.Info("deleting empty file", "path", y.Path)
+
+			if err := y.fs.Remove(y.Path); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
 			return err
 		}
 
-		util.Log.Info("deleting empty file", "path", y.Path)
-		return y.fs.Remove(y.Path)
+		return y.removeFiles()
 	}
 
-	if err := y.fs.MkdirAll(filepath.Dir(y.Path), 0700); err != nil {
-		return err
-	}
-
-	outFile, err := y.fs.Create(y.Path)
-	if err != nil {
-		return err
-	}
+	// The file is only replaced once every object has been marshalled, so that an
+	// object that cannot be written does not truncate it.
+	outFile := &bytes.Buffer{}
 
-	defer outFile.Close()
+	written := map[*list]bool{}
 
 	for index, obj := range y.Objects {
-		if index != 0 {
+		if obj.list != nil {
+			if !written[obj.list] {
+				if err := obj.list.write(outFile, index == 0); err != nil {
+					return err
+				}
+
+				written[obj.list] = true
+			}
+
+			continue
+		}
+
+		if _, err := outFile.Write(obj.preceding); err != nil {
+			return err
+		}
+
+		// Objects that have not changed are written back exactly as they were read.
+		if !obj.Changed() {
+			if err := writeDocument(outFile, obj.separator, obj.data); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if len(obj.separator) != 0 {
+			if _, err := outFile.Write(obj.separator); err != nil {
+				return err
+			}
+		} else if index != 0 || len(obj.preceding) != 0 {
 			outFile.Write([]byte("---\n"))
 		}
 
@@ -136,5 +458,65 @@ func (y *File) Dump() error {
 		}
 	}
 
+	// Documents at the end of the file that are not preceded by a separator, such as
+	// the first document of a file whose objects were all removed, would otherwise be
+	// merged with the last object.
+	if len(y.Objects) != 0 && holdsDocuments(y.trailer) {
+		if documents, _ := splitDocuments(y.trailer); len(documents[0].separator) == 0 {
+			if _, err := outFile.Write([]byte("---\n")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := outFile.Write(y.trailer); err != nil {
+		return err
+	}
+
+	if err := y.checkFiles(); err != nil {
+		return err
+	}
+
+	if err := y.fs.MkdirAll(filepath.Dir(y.Path), 0700); err != nil {
+		return err
+	}
+
+	file, err := y.fs.Create(y.Path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if _, err := outFile.WriteTo(file); err != nil {
+		return err
+	}
+
+	for _, obj := range y.Objects {
+		if err := y.writeFiles(obj); err != nil {
+			return err
+		}
+	}
+
+	return y.removeFiles()
+}
+
+// Write a document exactly as it was read, ending it with a newline if it does not
+// have one.
+func writeDocument(w io.Writer, separator, data []byte) error {
+	if _, err := w.Write(separator); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		if _, err := w.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
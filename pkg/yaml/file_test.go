@@ -0,0 +1,328 @@
+package yaml
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, fs billy.Filesystem, path string) string {
+	file, err := fs.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	assert.Nil(t, err)
+	return string(contents)
+}
+
+func TestDumpPreservesFormatting(t *testing.T) {
+	original := `# The frontend deployment.
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+  namespace: default
+spec:
+  # Scaled for peak traffic.
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - name: frontend   # the main container
+        image: "nginx:1.15"
+---
+# The backend deployment.
+apiVersion:   apps/v1
+kind: Deployment
+metadata: {name: backend, namespace: default}
+# trailing comment
+`
+
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "deploy.yaml", []byte(original), 0644))
+
+	file := NewFile(fs, "deploy.yaml")
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(objects))
+
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, original, readFile(t, fs, "deploy.yaml"))
+
+	obj := objects[0].Object.DeepCopyObject().(*unstructured.Unstructured)
+	unstructured.SetNestedField(obj.Object, int64(5), "spec", "replicas")
+	unstructured.SetNestedField(obj.Object, "green", "metadata", "labels", "color")
+	objects[0].SetObject(obj)
+
+	assert.Nil(t, objects[0].Save())
+	assert.Equal(t, `# The frontend deployment.
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+  namespace: default
+  labels:
+    color: green
+spec:
+  # Scaled for peak traffic.
+  replicas: 5
+  template:
+    spec:
+      containers:
+      - name: frontend   # the main container
+        image: "nginx:1.15"
+---
+# The backend deployment.
+apiVersion:   apps/v1
+kind: Deployment
+metadata: {name: backend, namespace: default}
+# trailing comment
+`, readFile(t, fs, "deploy.yaml"))
+}
+
+func TestDumpKeepsIndentation(t *testing.T) {
+	original := `apiVersion: v1
+kind: Pod
+metadata:
+    name: frontend
+spec:
+    containers:
+      - name: frontend
+        args:
+          - --port=80    # the public port
+`
+
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "pod.yaml", []byte(original), 0644))
+
+	file := NewFile(fs, "pod.yaml")
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+
+	obj := objects[0].Object.DeepCopyObject().(*unstructured.Unstructured)
+	unstructured.SetNestedField(obj.Object, "green", "metadata", "labels", "color")
+	objects[0].SetObject(obj)
+
+	assert.Nil(t, objects[0].Save())
+	assert.Equal(t, `apiVersion: v1
+kind: Pod
+metadata:
+    name: frontend
+    labels:
+        color: green
+spec:
+    containers:
+      - name: frontend
+        args:
+          - --port=80    # the public port
+`, readFile(t, fs, "pod.yaml"))
+}
+
+func TestDumpKeepsAnchors(t *testing.T) {
+	original := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ports
+data:
+  http: &http "80"
+  public: *http
+  admin: *http
+`
+
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "cm.yaml", []byte(original), 0644))
+
+	file := NewFile(fs, "cm.yaml")
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+
+	obj := objects[0].Object.DeepCopyObject().(*unstructured.Unstructured)
+	unstructured.SetNestedField(obj.Object, "8080", "data", "http")
+	unstructured.SetNestedField(obj.Object, "8080", "data", "public")
+	objects[0].SetObject(obj)
+
+	assert.Nil(t, objects[0].Save())
+	assert.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ports
+data:
+  http: &http "8080"
+  public: *http
+  admin: "80"
+`, readFile(t, fs, "cm.yaml"))
+
+	// Aliases of a removed node are replaced with its value.
+	objects, err = NewFile(fs, "cm.yaml").Load()
+	assert.Nil(t, err)
+
+	obj = objects[0].Object.DeepCopyObject().(*unstructured.Unstructured)
+	unstructured.RemoveNestedField(obj.Object, "data", "http")
+	objects[0].SetObject(obj)
+
+	assert.Nil(t, objects[0].Save())
+	assert.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ports
+data:
+  public: "8080"
+  admin: "80"
+`, readFile(t, fs, "cm.yaml"))
+}
+
+func TestDumpRemovesObjects(t *testing.T) {
+	original := `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: first
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: second # keep me
+`
+
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "cm.yaml", []byte(original), 0644))
+
+	file := NewFile(fs, "cm.yaml")
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(objects))
+
+	assert.Nil(t, objects[0].Delete())
+	assert.Equal(t, `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: second # keep me
+`, readFile(t, fs, "cm.yaml"))
+}
+
+func TestLoadSkipsInvalidDocuments(t *testing.T) {
+	original := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: first
+---
+# Not a Kubernetes object.
+replicas: 3
+---
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: second
+---
+apiVersion: v1
+kind: ConfigMap
+metadata: [
+`
+
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "cm.yaml", []byte(original), 0644))
+
+	file := NewFile(fs, "cm.yaml")
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(objects))
+	assert.Equal(t, "first", objects[0].Name())
+	assert.Equal(t, "second", objects[1].Name())
+
+	assert.Equal(t, 2, len(file.Invalid))
+	assert.Equal(t, 6, file.Invalid[0].Line)
+	assert.Equal(t, 15, file.Invalid[1].Line)
+
+	// Invalid documents are kept when objects around them are removed.
+	file.RemoveResource(objects[1])
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: first
+---
+# Not a Kubernetes object.
+replicas: 3
+---
+apiVersion: v1
+kind: ConfigMap
+metadata: [
+`, readFile(t, fs, "cm.yaml"))
+
+	file.RemoveResource(objects[0])
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, `---
+# Not a Kubernetes object.
+replicas: 3
+---
+apiVersion: v1
+kind: ConfigMap
+metadata: [
+`, readFile(t, fs, "cm.yaml"))
+}
+
+func TestAddResourceAfterInvalidDocuments(t *testing.T) {
+	for _, original := range []string{
+		"metadata: [",
+		"# Broken.\nmetadata: [\n---\nreplicas: 3\n",
+	} {
+		fs := memfs.New()
+		assert.Nil(t, util.WriteFile(fs, "cm.yaml", []byte(original), 0644))
+
+		file := NewFile(fs, "cm.yaml")
+		_, err := file.Load()
+		assert.Nil(t, err)
+
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion("v1")
+		obj.SetKind("ConfigMap")
+		obj.SetName("added")
+
+		file.AddResource(&Object{Object: obj})
+		assert.Nil(t, file.Dump())
+
+		// The new object is added after the invalid documents, separated from them.
+		expected := strings.TrimSuffix(original, "\n") + "\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: added\n"
+		assert.Equal(t, expected, readFile(t, fs, "cm.yaml"))
+
+		objects, err := NewFile(fs, "cm.yaml").Load()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(objects))
+	}
+}
+
+func TestAddResourceIsGroupAware(t *testing.T) {
+	file := NewFile(memfs.New(), "ingress.yaml")
+
+	extensions := &unstructured.Unstructured{}
+	extensions.SetAPIVersion("extensions/v1beta1")
+	extensions.SetKind("Ingress")
+	extensions.SetName("frontend")
+
+	networking := extensions.DeepCopy()
+	networking.SetAPIVersion("networking.k8s.io/v1beta1")
+
+	file.AddResource(&Object{Object: extensions})
+	file.AddResource(&Object{Object: networking})
+	assert.Equal(t, 2, len(file.Objects))
+
+	newVersion := extensions.DeepCopy()
+	newVersion.SetAPIVersion("extensions/v1")
+
+	assert.True(t, file.Objects[0].Matches(newVersion))
+	assert.False(t, file.Objects[1].Matches(newVersion))
+
+	file.RemoveResource(&Object{Object: networking})
+	assert.Equal(t, 1, len(file.Objects))
+	assert.Equal(t, "extensions/v1beta1", file.Objects[0].Object.GetObjectKind().GroupVersionKind().GroupVersion().String())
+}
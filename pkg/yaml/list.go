@@ -0,0 +1,205 @@
+package yaml
+
+import (
+	"bytes"
+	"encoding/json"
+	yaml3 "go.yaml.in/yaml/v3"
+	"io"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// A document holding several objects, either a List or an array of objects such as
+// the output of `kubectl get -o json`. Each item is loaded as its own Object and
+// the document is written back in the same form when an item changes.
+type list struct {
+	// The list without its items, nil if the document is an array.
+	object map[string]interface{}
+	// The items that are still in the list, in order.
+	items []*Object
+	// The number of items when the list was loaded.
+	loaded int
+	// The node tree of the document, nil for JSON files.
+	node *yaml3.Node
+	// Invalid documents preceding the list, the separator preceding the document
+	// and the document's original contents.
+	preceding []byte
+	separator []byte
+	data      []byte
+}
+
+// Decode a document that holds a list of objects, returning true if the document
+// is an array rather than a List. Returns nil if the document is not a list.
+func decodeList(data []byte) (*unstructured.UnstructuredList, bool, error) {
+	jsonData, err := kyaml.ToJSON(data)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	jsonData = bytes.TrimSpace(jsonData)
+	array := bytes.HasPrefix(jsonData, []byte("["))
+
+	if array {
+		jsonData = []byte(`{"apiVersion":"v1","kind":"List","items":` + string(jsonData) + `}`)
+	} else {
+		header := struct {
+			Kind string `json:"kind"`
+		}{}
+
+		if err := json.Unmarshal(jsonData, &header); err != nil || header.Kind != "List" {
+			return nil, false, nil
+		}
+	}
+
+	decoded := &unstructured.UnstructuredList{}
+	if err := decoded.UnmarshalJSON(jsonData); err != nil {
+		return nil, array, err
+	}
+
+	return decoded, array, nil
+}
+
+// Return true if the list needs to be written again.
+func (l *list) changed() bool {
+	if len(l.items) != l.loaded {
+		return true
+	}
+
+	for _, item := range l.items {
+		if item.Changed() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remove an item from the list.
+func (l *list) remove(obj *Object) {
+	items := []*Object{}
+
+	for _, item := range l.items {
+		if item != obj {
+			items = append(items, item)
+		}
+	}
+
+	l.items = items
+}
+
+// Write the list. If first is true, the list is the first document in the file.
+func (l *list) write(w io.Writer, first bool) error {
+	if _, err := w.Write(l.preceding); err != nil {
+		return err
+	}
+
+	// Lists that have not changed are written back exactly as they were read.
+	if !l.changed() {
+		return writeDocument(w, l.separator, l.data)
+	}
+
+	if len(l.separator) != 0 {
+		if _, err := w.Write(l.separator); err != nil {
+			return err
+		}
+	} else if !first || len(l.preceding) != 0 {
+		if _, err := w.Write([]byte("---\n")); err != nil {
+			return err
+		}
+	}
+
+	items := []interface{}{}
+	for _, item := range l.items {
+		value, err := item.value()
+		if err != nil {
+			return err
+		}
+
+		items = append(items, value)
+	}
+
+	var value interface{} = items
+	if l.object != nil {
+		object := map[string]interface{}{}
+		for key, field := range l.object {
+			object[key] = field
+		}
+
+		object["items"] = items
+		value = object
+	}
+
+	if l.node == nil {
+		serialized, err := json.MarshalIndent(value, "", "    ")
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(append(serialized, '\n'))
+		return err
+	}
+
+	if err := l.updateNode(value); err != nil {
+		return err
+	}
+
+	serialized, err := encodeNode(l.node, l.data)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(serialized)
+	return err
+}
+
+// Return the sequence node holding the items of the list, or nil if it cannot be
+// found.
+func (l *list) itemsNode() *yaml3.Node {
+	root := l.node.Content[0]
+
+	if l.object == nil {
+		if root.Kind == yaml3.SequenceNode {
+			return root
+		}
+
+		return nil
+	}
+
+	if root.Kind != yaml3.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "items" && root.Content[i+1].Kind == yaml3.SequenceNode {
+			return root.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// Update the node tree of the list to match value. Each item keeps the node it was
+// loaded from, so that comments stay with their item when other items are removed.
+func (l *list) updateNode(value interface{}) error {
+	itemsNode := l.itemsNode()
+	if itemsNode == nil || len(itemsNode.Content) != l.loaded {
+		return updateNode(l.node, value)
+	}
+
+	content := []*yaml3.Node{}
+	for _, item := range l.items {
+		itemValue, err := item.value()
+		if err != nil {
+			return err
+		}
+
+		content = append(content, itemsNode.Content[item.listIndex])
+		if err := updateNode(itemsNode.Content[item.listIndex], itemValue); err != nil {
+			return err
+		}
+	}
+
+	itemsNode.Content = content
+	expandAliases(l.node)
+	return nil
+}
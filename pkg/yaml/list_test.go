@@ -0,0 +1,111 @@
+package yaml
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"testing"
+)
+
+func TestLoadList(t *testing.T) {
+	original := `apiVersion: v1
+kind: List
+items:
+# The first config map.
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: first
+  data:
+    key: value
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: second
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: third
+`
+
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "list.yaml", []byte(original), 0644))
+
+	file := NewFile(fs, "list.yaml")
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(objects))
+	assert.Equal(t, "first", objects[0].Name())
+	assert.True(t, objects[0].InList())
+	assert.Equal(t, "second", objects[1].Name())
+	assert.Equal(t, "third", objects[2].Name())
+	assert.False(t, objects[2].InList())
+
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, original, readFile(t, fs, "list.yaml"))
+
+	obj := objects[1].Object.DeepCopyObject().(*unstructured.Unstructured)
+	obj.SetLabels(map[string]string{"color": "green"})
+	objects[1].SetObject(obj)
+
+	file.RemoveResource(objects[0])
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: second
+    labels:
+      color: green
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: third
+`, readFile(t, fs, "list.yaml"))
+
+	file.RemoveResource(objects[1])
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: third
+`, readFile(t, fs, "list.yaml"))
+}
+
+func TestLoadJSONArray(t *testing.T) {
+	original := `[
+    {"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "first"}},
+    {"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "second"}, "data": {"replicas": "3"}}
+]
+`
+
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "list.json", []byte(original), 0644))
+
+	file := NewFile(fs, "list.json")
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(objects))
+
+	file.RemoveResource(objects[0])
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, `[
+    {
+        "apiVersion": "v1",
+        "data": {
+            "replicas": "3"
+        },
+        "kind": "ConfigMap",
+        "metadata": {
+            "name": "second"
+        }
+    }
+]
+`, readFile(t, fs, "list.json"))
+}
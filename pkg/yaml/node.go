@@ -0,0 +1,442 @@
+package yaml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	yaml3 "go.yaml.in/yaml/v3"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A single document in a YAML file, along with any separators and comment-only
+// documents that preceded it.
+type document struct {
+	separator []byte
+	data      []byte
+}
+
+// Return true if line is a YAML document separator.
+func isSeparator(line []byte) bool {
+	if !bytes.HasPrefix(line, []byte("---")) {
+		return false
+	}
+
+	return len(line) == 3 || line[3] == ' ' || line[3] == '\t' || line[3] == '\n' || line[3] == '\r'
+}
+
+// Return true if a document contains nothing but whitespace and comments.
+func isEmptyDocument(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) != 0 && line[0] != '#' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Split the contents of a YAML file into documents, keeping the exact bytes of the
+// separators so that the file can be reassembled byte for byte. Documents that only
+// contain comments are folded into the separator of the following document, any
+// left over at the end of the file are returned as the trailer.
+func splitDocuments(data []byte) ([]document, []byte) {
+	documents := []document{}
+	current := document{}
+	pending := []byte{}
+
+	finish := func() {
+		if isEmptyDocument(current.data) {
+			pending = append(pending, current.separator...)
+			pending = append(pending, current.data...)
+		} else {
+			current.separator = append(pending, current.separator...)
+			documents = append(documents, current)
+			pending = []byte{}
+		}
+
+		current = document{}
+	}
+
+	for len(data) != 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+
+		line := data[:end]
+		data = data[end:]
+
+		if isSeparator(line) {
+			finish()
+			current.separator = line
+			continue
+		}
+
+		current.data = append(current.data, line...)
+	}
+
+	finish()
+
+	return documents, pending
+}
+
+// Parse a document into a node tree, returning nil if it cannot be parsed.
+func parseNode(data []byte) *yaml3.Node {
+	node := &yaml3.Node{}
+	if err := yaml3.Unmarshal(data, node); err != nil {
+		return nil
+	}
+
+	if node.Kind != yaml3.DocumentNode || len(node.Content) == 0 {
+		return nil
+	}
+
+	return node
+}
+
+// Return the indentation of the mappings in a node tree and whether its sequences
+// are indented less than its mappings, such as sequences whose dashes line up with
+// their key. Only nodes that were loaded from the document are considered; mappings
+// default to two spaces and sequences to being in line with their key, the way new
+// objects are written.
+func detectIndent(node *yaml3.Node) (int, bool) {
+	mappingIndent, sequenceIndent := -1, -1
+
+	var walk func(*yaml3.Node)
+	walk = func(node *yaml3.Node) {
+		if node.Kind == yaml3.MappingNode && node.Style&yaml3.FlowStyle == 0 {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				if key.Line == 0 || value.Line <= key.Line || value.Style&yaml3.FlowStyle != 0 {
+					continue
+				}
+
+				if value.Kind == yaml3.MappingNode && mappingIndent == -1 && value.Column > key.Column {
+					mappingIndent = value.Column - key.Column
+				} else if value.Kind == yaml3.SequenceNode && sequenceIndent == -1 && value.Column >= key.Column {
+					sequenceIndent = value.Column - key.Column
+				}
+			}
+		}
+
+		for _, child := range node.Content {
+			walk(child)
+		}
+	}
+
+	walk(node)
+
+	if mappingIndent == -1 {
+		mappingIndent = 2
+		if sequenceIndent >= 2 {
+			mappingIndent = sequenceIndent
+		}
+	}
+
+	return mappingIndent, sequenceIndent == -1 || sequenceIndent < mappingIndent
+}
+
+// Return a line without trailing whitespace and with the whitespace before a
+// comment collapsed to a single space, the way comments are encoded.
+func normalizeLine(line []byte) string {
+	line = bytes.TrimRight(line, " \t\r")
+
+	normalized := []byte{}
+	for i := 0; i < len(line); i++ {
+		if line[i] == ' ' || line[i] == '\t' {
+			end := i
+			for end < len(line) && (line[end] == ' ' || line[end] == '\t') {
+				end++
+			}
+
+			if i != 0 && end < len(line) && line[end] == '#' {
+				normalized = append(normalized, ' ')
+				i = end - 1
+				continue
+			}
+		}
+
+		normalized = append(normalized, line[i])
+	}
+
+	return string(normalized)
+}
+
+// Replace the lines of an encoded document that only differ from a line of the
+// original document in the spacing of their comments with the original line.
+// Lines that match several different original lines are left as they are.
+func restoreLines(encoded, original []byte) []byte {
+	lines := map[string][]byte{}
+	ambiguous := map[string]bool{}
+
+	for _, line := range bytes.Split(original, []byte("\n")) {
+		key := normalizeLine(line)
+		if existing, ok := lines[key]; ok && !bytes.Equal(existing, line) {
+			ambiguous[key] = true
+		}
+
+		lines[key] = line
+	}
+
+	restored := [][]byte{}
+	for _, line := range bytes.Split(encoded, []byte("\n")) {
+		key := normalizeLine(line)
+		if originalLine, ok := lines[key]; ok && !ambiguous[key] && len(line) != 0 {
+			line = originalLine
+		}
+
+		restored = append(restored, line)
+	}
+
+	return bytes.Join(restored, []byte("\n"))
+}
+
+// Serialize a node tree with the indentation of the document it was loaded from,
+// keeping the spacing of comments on lines that did not change.
+func encodeNode(node *yaml3.Node, original []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	indent, compact := detectIndent(node)
+
+	encoder := yaml3.NewEncoder(buf)
+	encoder.SetIndent(indent)
+	if compact {
+		encoder.CompactSeqIndent()
+	}
+
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return restoreLines(buf.Bytes(), original), nil
+}
+
+// Return true if two scalar nodes represent the same value.
+func scalarsEqual(a, b *yaml3.Node) bool {
+	aTag := a.ShortTag()
+	bTag := b.ShortTag()
+
+	if aTag == bTag {
+		return a.Value == b.Value
+	}
+
+	numeric := map[string]bool{
+		"!!int":   true,
+		"!!float": true,
+	}
+
+	if !numeric[aTag] || !numeric[bTag] {
+		return false
+	}
+
+	aValue, err := strconv.ParseFloat(strings.Replace(a.Value, "_", "", -1), 64)
+	if err != nil {
+		return false
+	}
+
+	bValue, err := strconv.ParseFloat(strings.Replace(b.Value, "_", "", -1), 64)
+	if err != nil {
+		return false
+	}
+
+	return aValue == bValue
+}
+
+// Return true if an alias node refers to a node that represents value.
+func aliasMatches(node *yaml3.Node, value interface{}) bool {
+	var target interface{}
+	if err := node.Alias.Decode(&target); err != nil {
+		return false
+	}
+
+	targetJSON, err := json.Marshal(target)
+	if err != nil {
+		return false
+	}
+
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(targetJSON, valueJSON)
+}
+
+// Return a copy of node and its children without their anchors or positions.
+func copyNode(node *yaml3.Node) *yaml3.Node {
+	copied := *node
+	copied.Anchor = ""
+	copied.Line = 0
+	copied.Column = 0
+	copied.Content = nil
+
+	for _, child := range node.Content {
+		copied.Content = append(copied.Content, copyNode(child))
+	}
+
+	return &copied
+}
+
+// Replace the aliases in a node tree whose anchor is not defined before them, such
+// as aliases of a node that was removed, with copies of the node they refer to.
+func expandAliases(node *yaml3.Node) {
+	defined := map[*yaml3.Node]bool{}
+
+	var walk func(*yaml3.Node)
+	walk = func(node *yaml3.Node) {
+		if node.Kind == yaml3.AliasNode && !defined[node.Alias] {
+			*node = *copyNode(node.Alias)
+		}
+
+		if node.Anchor != "" {
+			defined[node] = true
+		}
+
+		for _, child := range node.Content {
+			walk(child)
+		}
+	}
+
+	walk(node)
+}
+
+// Update node in place so that it represents value. Keys, items and scalars that
+// did not change keep their comments, order and style, anchors are kept and aliases
+// are kept as long as the node they refer to still represents their value.
+func updateNode(node *yaml3.Node, value interface{}) error {
+	if node.Kind == yaml3.DocumentNode {
+		if len(node.Content) == 0 {
+			return fmt.Errorf("empty document")
+		}
+
+		if err := updateNode(node.Content[0], value); err != nil {
+			return err
+		}
+
+		expandAliases(node)
+		return nil
+	}
+
+	if node.Kind == yaml3.AliasNode && aliasMatches(node, value) {
+		return nil
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if node.Kind == yaml3.MappingNode {
+			return updateMapping(node, v)
+		}
+	case []interface{}:
+		if node.Kind == yaml3.SequenceNode {
+			return updateSequence(node, v)
+		}
+	}
+
+	replacement := &yaml3.Node{}
+	if err := replacement.Encode(value); err != nil {
+		return err
+	}
+
+	if node.Kind == yaml3.ScalarNode && replacement.Kind == yaml3.ScalarNode {
+		if scalarsEqual(node, replacement) {
+			return nil
+		}
+
+		if node.ShortTag() != replacement.ShortTag() {
+			node.Style = replacement.Style
+		}
+	} else {
+		node.Style = replacement.Style
+	}
+
+	node.Kind = replacement.Kind
+	node.Tag = replacement.Tag
+	node.Value = replacement.Value
+	node.Alias = nil
+	node.Content = replacement.Content
+	return nil
+}
+
+// Update a mapping node to match value, removing keys that are no longer present
+// and appending new keys in sorted order.
+func updateMapping(node *yaml3.Node, value map[string]interface{}) error {
+	content := []*yaml3.Node{}
+	seen := map[string]bool{}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		val := node.Content[i+1]
+
+		newValue, ok := value[key.Value]
+		if !ok {
+			continue
+		}
+
+		if err := updateNode(val, newValue); err != nil {
+			return err
+		}
+
+		seen[key.Value] = true
+		content = append(content, key, val)
+	}
+
+	keys := []string{}
+	for key := range value {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyNode := &yaml3.Node{}
+		if err := keyNode.Encode(key); err != nil {
+			return err
+		}
+
+		valueNode := &yaml3.Node{}
+		if err := valueNode.Encode(value[key]); err != nil {
+			return err
+		}
+
+		content = append(content, keyNode, valueNode)
+	}
+
+	node.Content = content
+	return nil
+}
+
+// Update a sequence node to match value, updating items in place and truncating or
+// appending items if the length changed.
+func updateSequence(node *yaml3.Node, value []interface{}) error {
+	content := []*yaml3.Node{}
+
+	for i, item := range value {
+		if i < len(node.Content) {
+			if err := updateNode(node.Content[i], item); err != nil {
+				return err
+			}
+
+			content = append(content, node.Content[i])
+			continue
+		}
+
+		itemNode := &yaml3.Node{}
+		if err := itemNode.Encode(item); err != nil {
+			return err
+		}
+
+		content = append(content, itemNode)
+	}
+
+	node.Content = content
+	return nil
+}
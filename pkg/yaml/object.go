@@ -2,14 +2,42 @@ package yaml
 
 import (
 	"github.com/justinbarrick/gitops-controller/pkg/util"
+	yaml3 "go.yaml.in/yaml/v3"
 	"io"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"reflect"
 )
 
 // Stores a reference to an object and a file so that the object can be manipulated.
 type Object struct {
 	File   *File
 	Object runtime.Object
+	// The object as it was loaded from the file.
+	original runtime.Object
+	// The node tree of the document the object was loaded from, used to preserve
+	// comments and formatting when the object is updated.
+	node *yaml3.Node
+	// The object before placeholders were expanded, if the file has variables.
+	template map[string]interface{}
+	// The object before its values were decrypted, if the file has encryption.
+	encrypted map[string]interface{}
+	// The list the object is an item of, the item as it was read from the file and
+	// its position in the list, if the object was loaded from a List or an array.
+	list      *list
+	raw       map[string]interface{}
+	listIndex int
+	// The fields stored in separate files, mapped to their paths relative to the
+	// manifest, as loaded and as of the last time the object was serialized, and
+	// the contents to write to the files, nil until the object is serialized.
+	files    map[string]string
+	newFiles map[string]string
+	contents map[string][]byte
+	// Invalid documents preceding the object's document in the file.
+	preceding []byte
+	// The separator preceding the document and the document's original contents.
+	separator []byte
+	data      []byte
 }
 
 // Return the name of the object as a string.
@@ -26,8 +54,8 @@ func (o *Object) Name() string {
 	return meta.GetName()
 }
 
-// Return true if the version/kind/name/namespace of obj match the object
-// in the Object.
+// Return true if the group/kind/name/namespace of obj match the object in the
+// Object. Objects at different versions of the same group match.
 func (o *Object) Matches(obj runtime.Object) bool {
 	actualMeta := util.GetMeta(o.Object)
 	expectedMeta := util.GetMeta(obj)
@@ -46,6 +74,10 @@ func (o *Object) Matches(obj runtime.Object) bool {
 		return false
 	}
 
+	if actualType.Group != expectedType.Group {
+		return false
+	}
+
 	return true
 }
 
@@ -67,6 +99,177 @@ func (o *Object) Save() error {
 	return o.File.Dump()
 }
 
+// Return true if the object has been modified since it was loaded, or if it was
+// never loaded from a file. Redacted values are unchanged if their hashes match.
+func (o *Object) Changed() bool {
+	if o.original == nil {
+		return true
+	}
+
+	current := o.Object
+	if o.File != nil && (o.Redacted() || o.File.Redaction.hasFields(util.GetType(o.Object).Kind)) {
+		redacted, err := o.Redact(o.Object)
+		if err != nil {
+			return true
+		}
+
+		current = redacted
+	}
+
+	return !reflect.DeepEqual(util.StripObject(o.original), util.StripObject(current))
+}
+
+// Return the object as it was loaded, or nil if it was never loaded.
+func (o *Object) originalValue() map[string]interface{} {
+	if o.original == nil {
+		return nil
+	}
+
+	value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(o.original)
+	if err != nil {
+		return nil
+	}
+
+	return value
+}
+
+// Return true if the object was loaded with redacted values. Redacted objects must
+// not be restored to Kubernetes, since their values are lost.
+func (o *Object) Redacted() bool {
+	return IsRedacted(o.originalValue())
+}
+
+// Return obj with the values that are redacted in the object, or that the object's
+// file redacts, replaced with their placeholders, so that it can be compared with
+// the object.
+func (o *Object) Redact(obj runtime.Object) (runtime.Object, error) {
+	var redaction *Redaction
+	if o.File != nil {
+		redaction = o.File.Redaction
+	}
+
+	value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	redacted, err := redaction.Redact(o.originalValue(), value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unstructured.Unstructured{Object: redacted}, nil
+}
+
+// Return obj and the object with the values that are encrypted in Git masked, so
+// that the changes between them can be shown without their plaintext.
+func (o *Object) MaskEncrypted(obj runtime.Object) (runtime.Object, runtime.Object, error) {
+	if o.File == nil || (o.encrypted == nil && !o.File.Encryption.hasFields(util.GetType(obj).Kind)) {
+		return obj, o.Object, nil
+	}
+
+	value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	original, err := runtime.DefaultUnstructuredConverter.ToUnstructured(o.Object)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryption := o.File.Encryption
+	masked := encryption.Mask(o.encrypted, original, value)
+	maskedOriginal := encryption.Mask(o.encrypted, original, original)
+
+	return &unstructured.Unstructured{Object: masked}, &unstructured.Unstructured{Object: maskedOriginal}, nil
+}
+
+// Return true if the object was loaded from a List or an array of objects.
+func (o *Object) InList() bool {
+	return o.list != nil
+}
+
+// Return true if the object is not written as it is in memory, because it has
+// placeholders, redacted or encrypted values or fields stored in separate files.
+func (o *Object) transformed() bool {
+	if o.template != nil || o.encrypted != nil || o.files != nil {
+		return true
+	}
+
+	kind := util.GetType(o.Object).Kind
+	return o.File.Redaction.hasFields(kind) || o.File.Encryption.hasFields(kind) ||
+		o.File.External.hasFields(kind) || o.Redacted()
+}
+
+// Return the object as it should be written to its file, with placeholders put back
+// in place of their values, redacted and encrypted fields redacted and encrypted
+// and fields stored in separate files replaced with references. Unchanged list
+// items are returned as they were read.
+func (o *Object) value() (map[string]interface{}, error) {
+	if o.raw != nil && !o.Changed() {
+		return o.raw, nil
+	}
+
+	value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(util.StripObject(o.Object))
+	if err != nil {
+		return nil, err
+	}
+
+	if o.template != nil && o.File != nil && o.File.Variables != nil {
+		value = o.File.Variables.Restore(o.template, value).(map[string]interface{})
+	}
+
+	if o.File != nil && (o.Redacted() || o.File.Redaction.hasFields(util.GetType(o.Object).Kind)) {
+		value, err = o.File.Redaction.Redact(o.originalValue(), value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.File != nil && (o.encrypted != nil || o.File.Encryption.hasFields(util.GetType(o.Object).Kind)) {
+		value, err = o.File.Encryption.Encrypt(o.encrypted, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.File != nil && (o.files != nil || o.File.External.hasFields(util.GetType(o.Object).Kind)) {
+		o.newFiles, o.contents, err = o.File.External.externalize(value, o.files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return value, nil
+}
+
+// Serialize the object. If the object was loaded from a file, only the changed
+// fields are updated in the original document so that comments and formatting are
+// preserved and placeholders are put back in place of their values.
 func (o *Object) Marshal(w io.Writer) error {
-	return util.MarshalObject(o.Object, w)
+	if o.node == nil && !o.transformed() {
+		return util.MarshalObject(o.Object, w)
+	}
+
+	value, err := o.value()
+	if err != nil {
+		return err
+	}
+
+	if o.node == nil {
+		return util.MarshalObject(&unstructured.Unstructured{Object: value}, w)
+	}
+
+	if err := updateNode(o.node, value); err != nil {
+		return err
+	}
+
+	serialized, err := encodeNode(o.node, o.data)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(serialized)
+	return err
 }
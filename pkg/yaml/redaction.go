@@ -0,0 +1,157 @@
+package yaml
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+)
+
+// Matches the placeholders of redacted values, REDACTED[sha256:<hex digest>].
+var redactedRegexp = regexp.MustCompile(`^REDACTED\[sha256:[0-9a-f]{64}\]$`)
+
+// A field whose values are redacted in Git.
+type RedactedField struct {
+	Kind string
+	// Dot separated path of the field. Every string below the field is redacted.
+	Path string
+}
+
+// The fields redacted when no fields are configured.
+var DefaultRedactedFields = []RedactedField{
+	{Kind: "Secret", Path: "data"},
+	{Kind: "Secret", Path: "stringData"},
+}
+
+// Replaces the values of fields with a placeholder holding a hash of the value when
+// objects are written, so that the structure of objects is kept in Git without
+// their contents. Objects with redacted values cannot be restored from Git.
+type Redaction struct {
+	Fields []RedactedField
+	// The key values are hashed with using HMAC-SHA256, so that short values cannot
+	// be guessed from their hash. Placeholders only match while it stays the same.
+	Salt string
+}
+
+// Returned when values are redacted without a salt to hash them with.
+var errNoSalt = errors.New("redacted values cannot be hashed without redaction.saltSecret")
+
+// Return true if any fields of objects of kind are redacted.
+func (r *Redaction) hasFields(kind string) bool {
+	if r == nil {
+		return false
+	}
+
+	for _, field := range r.Fields {
+		if field.Kind == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the paths of the fields of objects of kind that are redacted.
+func (r *Redaction) fieldPaths(kind string) []string {
+	paths := []string{}
+
+	if r == nil {
+		return paths
+	}
+
+	for _, field := range r.Fields {
+		if field.Kind == kind {
+			paths = append(paths, field.Path)
+		}
+	}
+
+	return paths
+}
+
+// Return the placeholder for a value. The same value always has the same
+// placeholder.
+func (r *Redaction) placeholder(s string) string {
+	mac := hmac.New(sha256.New, []byte(r.Salt))
+	mac.Write([]byte(s))
+	return "REDACTED[sha256:" + hex.EncodeToString(mac.Sum(nil)) + "]"
+}
+
+// Return true if any string in value is a redacted placeholder.
+func IsRedacted(value interface{}) bool {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for _, item := range typed {
+			if IsRedacted(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range typed {
+			if IsRedacted(item) {
+				return true
+			}
+		}
+	case string:
+		return redactedRegexp.MatchString(typed)
+	}
+
+	return false
+}
+
+// Return a copy of value with the strings in the configured fields, and the strings
+// that are redacted in template, replaced with their placeholders. Placeholders in
+// value are kept as they are. A redacted object and the live object it was written
+// from are equal once the live object is redacted against it. Values are never
+// hashed without a salt, so redacting fails if the redaction has none.
+func (r *Redaction) Redact(template, value map[string]interface{}) (map[string]interface{}, error) {
+	if r == nil || r.Salt == "" {
+		return nil, errNoSalt
+	}
+
+	kind, _ := value["kind"].(string)
+	return r.redact(template, value, []string{}, r.fieldPaths(kind), false).(map[string]interface{}), nil
+}
+
+// Redact value, which is at path in the object. If force is true, value is below a
+// redacted field.
+func (r *Redaction) redact(template, value interface{}, path, fields []string, force bool) interface{} {
+	force = force || containsPath(fields, path)
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		templateMap, _ := template.(map[string]interface{})
+		redacted := map[string]interface{}{}
+
+		for key, item := range typed {
+			redacted[key] = r.redact(templateMap[key], item, append(path[:len(path):len(path)], key), fields, force)
+		}
+
+		return redacted
+	case []interface{}:
+		templateSlice, _ := template.([]interface{})
+		redacted := []interface{}{}
+
+		for i, item := range typed {
+			var templateItem interface{}
+			if i < len(templateSlice) {
+				templateItem = templateSlice[i]
+			}
+
+			redacted = append(redacted, r.redact(templateItem, item, path, fields, force))
+		}
+
+		return redacted
+	case string:
+		if redactedRegexp.MatchString(typed) {
+			return typed
+		}
+
+		templateString, _ := template.(string)
+		if force || redactedRegexp.MatchString(templateString) {
+			return r.placeholder(typed)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,86 @@
+package yaml
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	redaction := &Redaction{Fields: DefaultRedactedFields, Salt: "pepper"}
+	secret := func(password string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":      "database",
+				"namespace": "default",
+			},
+			"type": "Opaque",
+			"data": map[string]interface{}{
+				"password": password,
+			},
+		}}
+	}
+
+	fs := memfs.New()
+
+	file := NewFile(fs, "secret.yaml")
+	file.Redaction = redaction
+	file.AddResource(&Object{Object: secret("aHVudGVyMg==")})
+	assert.Nil(t, file.Dump())
+
+	placeholder := "REDACTED[sha256:72f80756c34f7cb3de2b97aa5b2a96837cf24a93a82b91a3e43612b2419d6765]"
+	assert.Equal(t, placeholder, redaction.placeholder("aHVudGVyMg=="))
+	assert.Equal(t, `apiVersion: v1
+data:
+  password: `+placeholder+`
+kind: Secret
+metadata:
+  name: database
+  namespace: default
+type: Opaque
+`, readFile(t, fs, "secret.yaml"))
+
+	file = NewFile(fs, "secret.yaml")
+	file.Redaction = redaction
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+	assert.True(t, objects[0].Redacted())
+
+	// The live object matches the redacted manifest if the hashes match.
+	redacted, err := objects[0].Redact(secret("aHVudGVyMg=="))
+	assert.Nil(t, err)
+	assert.Equal(t, placeholder, redacted.(*unstructured.Unstructured).Object["data"].(map[string]interface{})["password"])
+
+	objects[0].SetObject(secret("aHVudGVyMg=="))
+	assert.False(t, objects[0].Changed())
+
+	objects[0].SetObject(secret("c2VjcmV0"))
+	assert.True(t, objects[0].Changed())
+
+	// Values are never hashed without a salt.
+	file = NewFile(fs, "secret.yaml")
+	objects, err = file.Load()
+	assert.Nil(t, err)
+
+	_, err = objects[0].Redact(secret("aHVudGVyMg=="))
+	assert.Equal(t, errNoSalt, err)
+
+	objects[0].SetObject(secret("c2VjcmV0"))
+	assert.Equal(t, errNoSalt, objects[0].Save())
+	assert.Contains(t, readFile(t, fs, "secret.yaml"), placeholder)
+
+	// Values redacted in Git stay redacted when the field is not configured.
+	file = NewFile(fs, "secret.yaml")
+	file.Redaction = &Redaction{Salt: "pepper"}
+	objects, err = file.Load()
+	assert.Nil(t, err)
+
+	objects[0].SetObject(secret("c2VjcmV0"))
+	assert.Nil(t, objects[0].Save())
+	assert.Contains(t, readFile(t, fs, "secret.yaml"), redaction.placeholder("c2VjcmV0"))
+	assert.NotContains(t, readFile(t, fs, "secret.yaml"), "c2VjcmV0\n")
+}
@@ -0,0 +1,304 @@
+package yaml
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	yaml3 "go.yaml.in/yaml/v3"
+)
+
+// Matches ${VAR} and ${VAR:-default} placeholders.
+var placeholderRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Values that are substituted for ${VAR} placeholders in the string fields of
+// manifests when they are loaded. ${VAR:-default} uses default when VAR is not set.
+type Variables struct {
+	Values map[string]string
+	// If true, a placeholder without a value or a default is an error. Otherwise,
+	// the placeholder is left as is.
+	Strict bool
+}
+
+// Returned in strict mode when a placeholder has no value.
+type UndefinedVariableError struct {
+	Name string
+}
+
+func (e *UndefinedVariableError) Error() string {
+	return fmt.Sprintf("variable %s is not defined and has no default", e.Name)
+}
+
+// Return the value of a placeholder and whether it has one.
+func (v *Variables) lookup(match []string) (string, bool) {
+	if value, ok := v.Values[match[1]]; ok {
+		return value, true
+	}
+
+	if match[2] != "" {
+		return match[3], true
+	}
+
+	return "", false
+}
+
+// Expand the placeholders in a string.
+func (v *Variables) expandString(s string) (string, error) {
+	var err error
+
+	expanded := placeholderRegexp.ReplaceAllStringFunc(s, func(placeholder string) string {
+		match := placeholderRegexp.FindStringSubmatch(placeholder)
+
+		value, ok := v.lookup(match)
+		if ok {
+			return value
+		}
+
+		if v.Strict && err == nil {
+			err = &UndefinedVariableError{Name: match[1]}
+		}
+
+		return placeholder
+	})
+
+	return expanded, err
+}
+
+// Return true if s consists of a single placeholder and nothing else.
+func isPlaceholder(s string) bool {
+	loc := placeholderRegexp.FindStringIndex(s)
+	return loc != nil && loc[0] == 0 && loc[1] == len(s)
+}
+
+// Convert the value of an unquoted field that is only a placeholder to a number or
+// boolean, so that fields such as replicas can be set from variables.
+func parseScalar(s string) interface{} {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+
+	if s == "true" || s == "false" {
+		return s == "true"
+	}
+
+	return s
+}
+
+// Return the node of the value of key in a mapping node, or nil if there is none.
+func mappingValue(node *yaml3.Node, key string) *yaml3.Node {
+	if node == nil || node.Kind != yaml3.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// Return the node of item i in a sequence node, or nil if there is none.
+func sequenceItem(node *yaml3.Node, i int) *yaml3.Node {
+	if node == nil || node.Kind != yaml3.SequenceNode || i >= len(node.Content) {
+		return nil
+	}
+
+	return node.Content[i]
+}
+
+// Return a copy of value with the placeholders in every string expanded. node is
+// the node tree that value was loaded from, or nil. Fields that are only a
+// placeholder are converted to numbers or booleans only if they were written
+// without quotes, so that values such as "${PORT}" in a ConfigMap stay strings.
+func (v *Variables) Expand(value interface{}, node *yaml3.Node) (interface{}, error) {
+	if node != nil && node.Kind == yaml3.AliasNode {
+		node = node.Alias
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		expanded := map[string]interface{}{}
+
+		for key, item := range typed {
+			expandedItem, err := v.Expand(item, mappingValue(node, key))
+			if err != nil {
+				return nil, err
+			}
+
+			expanded[key] = expandedItem
+		}
+
+		return expanded, nil
+	case []interface{}:
+		expanded := []interface{}{}
+
+		for i, item := range typed {
+			expandedItem, err := v.Expand(item, sequenceItem(node, i))
+			if err != nil {
+				return nil, err
+			}
+
+			expanded = append(expanded, expandedItem)
+		}
+
+		return expanded, nil
+	case string:
+		expanded, err := v.expandString(typed)
+		if err != nil {
+			return nil, err
+		}
+
+		plain := node != nil && node.Kind == yaml3.ScalarNode && node.Style == 0
+		if plain && expanded != typed && isPlaceholder(typed) {
+			return parseScalar(expanded), nil
+		}
+
+		return expanded, nil
+	}
+
+	return value, nil
+}
+
+// Return a copy of value with the placeholders in template put back in place of
+// their values, so that writing value to Git does not bake in the values of this
+// cluster. Fields whose value is unchanged are replaced with the template, and
+// changed strings have the placeholders of the template put back around the change.
+func (v *Variables) Restore(template, value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		templateMap, ok := template.(map[string]interface{})
+		if !ok {
+			return value
+		}
+
+		restored := map[string]interface{}{}
+		for key, item := range typed {
+			if templateItem, ok := templateMap[key]; ok {
+				restored[key] = v.Restore(templateItem, item)
+			} else {
+				restored[key] = item
+			}
+		}
+
+		return restored
+	case []interface{}:
+		templateSlice, ok := template.([]interface{})
+		if !ok {
+			return value
+		}
+
+		restored := []interface{}{}
+		for i, item := range typed {
+			if i < len(templateSlice) {
+				restored = append(restored, v.Restore(templateSlice[i], item))
+			} else {
+				restored = append(restored, item)
+			}
+		}
+
+		return restored
+	}
+
+	templateString, ok := template.(string)
+	if !ok || !placeholderRegexp.MatchString(templateString) {
+		return value
+	}
+
+	expanded, err := v.expandString(templateString)
+	if err == nil && (expanded == fmt.Sprint(value) || fmt.Sprint(parseScalar(expanded)) == fmt.Sprint(value)) {
+		return templateString
+	}
+
+	valueString, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	return v.restoreString(templateString, valueString)
+}
+
+// A placeholder in a template and the position of its value in the expanded
+// template.
+type expansion struct {
+	placeholder string
+	start       int
+	end         int
+}
+
+// Expand the placeholders in a template, returning the expanded string and the
+// position of each placeholder's value in it.
+func (v *Variables) expansions(template string) (string, []expansion) {
+	expanded := ""
+	expansions := []expansion{}
+	last := 0
+
+	for _, loc := range placeholderRegexp.FindAllStringSubmatchIndex(template, -1) {
+		expanded += template[last:loc[0]]
+		last = loc[1]
+
+		match := []string{template[loc[0]:loc[1]], template[loc[2]:loc[3]], "", ""}
+		if loc[4] != -1 {
+			match[2] = template[loc[4]:loc[5]]
+			match[3] = template[loc[6]:loc[7]]
+		}
+
+		value, ok := v.lookup(match)
+		if !ok {
+			expanded += match[0]
+			continue
+		}
+
+		expansions = append(expansions, expansion{
+			placeholder: match[0],
+			start:       len(expanded),
+			end:         len(expanded) + len(value),
+		})
+		expanded += value
+	}
+
+	return expanded + template[last:], expansions
+}
+
+// Put the placeholders of a template back into a changed string. Only the
+// placeholders whose values are in the unchanged text before or after the change
+// are restored, at the position the template had them, so that a value that
+// happens to appear elsewhere in the string is left alone.
+func (v *Variables) restoreString(template, value string) string {
+	expanded, expansions := v.expansions(template)
+
+	prefix := 0
+	for prefix < len(expanded) && prefix < len(value) && expanded[prefix] == value[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(expanded)-prefix && suffix < len(value)-prefix &&
+		expanded[len(expanded)-suffix-1] == value[len(value)-suffix-1] {
+		suffix++
+	}
+
+	restored := ""
+	last := 0
+
+	for _, e := range expansions {
+		start, end := e.start, e.end
+
+		if start >= len(expanded)-suffix {
+			start += len(value) - len(expanded)
+			end += len(value) - len(expanded)
+		} else if end > prefix {
+			continue
+		}
+
+		restored += value[last:start] + e.placeholder
+		last = end
+	}
+
+	return restored + value[last:]
+}
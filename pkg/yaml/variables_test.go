@@ -0,0 +1,191 @@
+package yaml
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"testing"
+)
+
+func TestVariables(t *testing.T) {
+	original := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+  namespace: ${NAMESPACE:-default}
+spec:
+  replicas: ${REPLICAS}
+  template:
+    spec:
+      containers:
+      - name: frontend
+        image: ${REGISTRY}/frontend:v1
+`
+
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "deploy.yaml", []byte(original), 0644))
+
+	variables := &Variables{
+		Values: map[string]string{
+			"REPLICAS": "3",
+			"REGISTRY": "registry.example.com",
+		},
+	}
+
+	file := NewFile(fs, "deploy.yaml")
+	file.Variables = variables
+
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+
+	obj := objects[0].Object.(*unstructured.Unstructured)
+	assert.Equal(t, "default", obj.GetNamespace())
+
+	replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+
+	containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	assert.Equal(t, "registry.example.com/frontend:v1", containers[0].(map[string]interface{})["image"])
+
+	obj = obj.DeepCopy()
+	containers[0].(map[string]interface{})["image"] = "registry.example.com/frontend:v2"
+	unstructured.SetNestedSlice(obj.Object, containers, "spec", "template", "spec", "containers")
+	unstructured.SetNestedField(obj.Object, "green", "metadata", "labels", "color")
+	objects[0].SetObject(obj)
+
+	assert.Nil(t, file.Dump())
+	assert.Equal(t, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+  namespace: ${NAMESPACE:-default}
+  labels:
+    color: green
+spec:
+  replicas: ${REPLICAS}
+  template:
+    spec:
+      containers:
+      - name: frontend
+        image: ${REGISTRY}/frontend:v2
+`, readFile(t, fs, "deploy.yaml"))
+}
+
+func TestStrictVariables(t *testing.T) {
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "cm.yaml", []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ${NAME}
+`), 0644))
+
+	file := NewFile(fs, "cm.yaml")
+	file.Variables = &Variables{}
+
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "${NAME}", objects[0].Name())
+
+	file = NewFile(fs, "cm.yaml")
+	file.Variables = &Variables{Strict: true}
+
+	objects, err = file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(objects))
+	assert.Equal(t, 1, len(file.Invalid))
+	assert.Equal(t, "variable NAME is not defined and has no default", file.Invalid[0].Error)
+}
+
+func TestQuotedVariables(t *testing.T) {
+	fs := memfs.New()
+	assert.Nil(t, util.WriteFile(fs, "cm.yaml", []byte(`apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: settings
+  data:
+    port: "${PORT}"
+    version: '${VERSION}'
+    enabled: ${ENABLED}
+`), 0644))
+
+	file := NewFile(fs, "cm.yaml")
+	file.Variables = &Variables{
+		Values: map[string]string{
+			"PORT":    "8080",
+			"VERSION": "1.10",
+			"ENABLED": "true",
+		},
+	}
+
+	objects, err := file.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objects))
+
+	data := objects[0].Object.(*unstructured.Unstructured).Object["data"].(map[string]interface{})
+	assert.Equal(t, "8080", data["port"])
+	assert.Equal(t, "1.10", data["version"])
+	assert.Equal(t, true, data["enabled"])
+}
+
+func TestRestoreVariables(t *testing.T) {
+	variables := &Variables{
+		Values: map[string]string{
+			"REPLICAS": "1",
+			"REGISTRY": "registry.example.com",
+			"TAG":      "v1",
+		},
+	}
+
+	for _, test := range []struct {
+		name     string
+		template interface{}
+		value    interface{}
+		expected interface{}
+	}{
+		{
+			name:     "unchanged",
+			template: "${REPLICAS}",
+			value:    int64(1),
+			expected: "${REPLICAS}",
+		},
+		{
+			name:     "changed placeholder",
+			template: "${REPLICAS}",
+			value:    int64(2),
+			expected: int64(2),
+		},
+		{
+			name:     "change after placeholder",
+			template: "${REGISTRY}/frontend:${TAG}",
+			value:    "registry.example.com/frontend:v2",
+			expected: "${REGISTRY}/frontend:v2",
+		},
+		{
+			name:     "change before placeholder",
+			template: "${REGISTRY}/frontend:${TAG}",
+			value:    "registry.example.com/backend:v1",
+			expected: "${REGISTRY}/backend:${TAG}",
+		},
+		{
+			name:     "value elsewhere in the string",
+			template: "runs ${REPLICAS} replica",
+			value:    "runs 1 replica, 1 ready",
+			expected: "runs ${REPLICAS} replica, 1 ready",
+		},
+		{
+			name:     "not a template",
+			template: "1",
+			value:    "11",
+			expected: "11",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, variables.Restore(test.template, test.value))
+		})
+	}
+}